@@ -0,0 +1,240 @@
+package mnemosyne
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultAdminKeysLimit = 100
+
+// AdminOptions configures the admin handler
+type AdminOptions struct {
+	// Authorize is called before serving each request, a non-nil error
+	// rejects the request with 403 Forbidden
+	Authorize func(r *http.Request) error
+	// AllowWrites enables the endpoints which delete keys and flush layers.
+	// Without it they are rejected with 403 Forbidden, even if Authorize
+	// accepts the request.
+	AllowWrites bool
+}
+
+type adminHandler struct {
+	mnemosyne *Mnemosyne
+	opts      AdminOptions
+	mux       *http.ServeMux
+}
+
+// NewAdminHandler returns an http.Handler to inspect and manage the cache
+// instances of m. It serves the following endpoints, relative to where it is
+// mounted (use http.StripPrefix when mounting it under a path):
+//
+//	GET    /instances                                  instances and their layers
+//	GET    /instances/{instance}/keys/{key}            state of key in each layer
+//	DELETE /instances/{instance}/keys/{key}            delete key from all layers
+//	GET    /instances/{instance}/layers/{layer}/keys   keys of a layer (?pattern=&limit=)
+//	POST   /instances/{instance}/layers/{layer}/flush  flush a layer
+//	GET    /instances/{instance}/stats                 statistics of the instance
+//
+// The DELETE and flush endpoints are only served with opts.AllowWrites.
+func NewAdminHandler(m *Mnemosyne, opts AdminOptions) http.Handler {
+	h := &adminHandler{
+		mnemosyne: m,
+		opts:      opts,
+		mux:       http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /instances", h.listInstances)
+	h.mux.HandleFunc("GET /instances/{instance}/keys/{key...}", h.inspectKey)
+	h.mux.HandleFunc("DELETE /instances/{instance}/keys/{key...}", h.writes(h.deleteKey))
+	h.mux.HandleFunc("GET /instances/{instance}/layers/{layer}/keys", h.listKeys)
+	h.mux.HandleFunc("POST /instances/{instance}/layers/{layer}/flush", h.writes(h.flushLayer))
+	h.mux.HandleFunc("GET /instances/{instance}/stats", h.stats)
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.opts.Authorize != nil {
+		if err := h.opts.Authorize(r); err != nil {
+			writeAdminError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// writes guards an endpoint which changes the cache
+func (h *adminHandler) writes(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.opts.AllowWrites {
+			writeAdminError(w, http.StatusForbidden, errors.New("admin handler is read-only, set AllowWrites to enable this endpoint"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+type adminLayer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type adminInstance struct {
+	Name   string       `json:"name"`
+	Layers []adminLayer `json:"layers"`
+}
+
+type adminEntry struct {
+	Layer    string          `json:"layer"`
+	Present  bool            `json:"present"`
+	Age      string          `json:"age,omitempty"`
+	TTL      string          `json:"ttl,omitempty"`
+	Size     int             `json:"size,omitempty"`
+	CachedAt *time.Time      `json:"cached_at,omitempty"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func (h *adminHandler) instance(w http.ResponseWriter, r *http.Request) (*MnemosyneInstance, bool) {
+	instance, ok := h.mnemosyne.instances[r.PathValue("instance")]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, errors.New("cache instance not found"))
+	}
+	return instance, ok
+}
+
+func (h *adminHandler) listInstances(w http.ResponseWriter, _ *http.Request) {
+	names := h.mnemosyne.Instances()
+	instances := make([]adminInstance, 0, len(names))
+	for _, name := range names {
+		instance := adminInstance{Name: name}
+		for _, layer := range h.mnemosyne.instances[name].Layers() {
+			instance.Layers = append(instance.Layers, adminLayer{Name: layer.Name, Type: layer.Type})
+		}
+		instances = append(instances, instance)
+	}
+	writeAdminJSON(w, http.StatusOK, instances)
+}
+
+func (h *adminHandler) inspectKey(w http.ResponseWriter, r *http.Request) {
+	instance, ok := h.instance(w, r)
+	if !ok {
+		return
+	}
+	layers := instance.Inspect(r.Context(), r.PathValue("key"))
+	entries := make([]adminEntry, len(layers))
+	for i, layer := range layers {
+		entries[i] = adminEntry{
+			Layer:   layer.Layer,
+			Present: layer.Present,
+			Size:    layer.Size,
+			Value:   layer.Value,
+			Error:   layer.Error,
+		}
+		if layer.Present {
+			entries[i].TTL = layer.TTL.String()
+		}
+		if !layer.CachedAt.IsZero() {
+			cachedAt := layer.CachedAt
+			entries[i].CachedAt = &cachedAt
+			entries[i].Age = layer.Age.String()
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]any{
+		"key":    r.PathValue("key"),
+		"layers": entries,
+	})
+}
+
+func (h *adminHandler) deleteKey(w http.ResponseWriter, r *http.Request) {
+	instance, ok := h.instance(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	if err := instance.Delete(r.Context(), key); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logrus.WithField("cache", instance.name).
+		WithField("key_hash", keyHash(key)).
+		Info("key deleted through admin handler")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) listKeys(w http.ResponseWriter, r *http.Request) {
+	instance, ok := h.instance(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultAdminKeysLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			writeAdminError(w, http.StatusBadRequest, errors.New("limit must be a positive integer"))
+			return
+		}
+		limit = parsed
+	}
+
+	keys := []string{}
+	for key, err := range instance.Keys(r.Context(), r.PathValue("layer"), r.URL.Query().Get("pattern")) {
+		if errors.Is(err, ErrLayerNotFound) {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		keys = append(keys, key)
+		if len(keys) >= limit {
+			break
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
+
+func (h *adminHandler) flushLayer(w http.ResponseWriter, r *http.Request) {
+	instance, ok := h.instance(w, r)
+	if !ok {
+		return
+	}
+	layer := r.PathValue("layer")
+	if err := instance.Flush(layer); errors.Is(err, ErrLayerNotFound) {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logrus.WithField("cache", instance.name).
+		WithField("layer", layer).
+		Warn("layer flushed through admin handler")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) stats(w http.ResponseWriter, r *http.Request) {
+	instance, ok := h.instance(w, r)
+	if !ok {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]any{
+		"stats":  instance.Stats(),
+		"memory": instance.MemoryStats(),
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logrus.WithError(err).Warn("failed to write admin response")
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
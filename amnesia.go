@@ -0,0 +1,125 @@
+package mnemosyne
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Amnesia modes decide which reads of a layer fall through to the next one
+const (
+	// AmnesiaRandom forgets each read with the configured chance
+	AmnesiaRandom = "random"
+	// AmnesiaDeterministic forgets a key for whole windows, chosen by hashing
+	// the key and the window, so the same keys fall through in every process
+	AmnesiaDeterministic = "deterministic"
+	// AmnesiaAgeWeighted forgets entries with a chance that grows linearly
+	// with their age, reaching the configured chance at the layer TTL
+	AmnesiaAgeWeighted = "age-weighted"
+)
+
+const defaultAmnesiaWindow = time.Minute
+
+type amnesiaMode struct {
+	mode   string
+	window time.Duration
+	ttl    time.Duration
+	// now and random are only replaced in tests, a nil random uses the
+	// global source, which does not serialise concurrent reads
+	now    func() time.Time
+	random *lockedRand
+}
+
+// lockedRand is a seeded source of randomness safe for concurrent use. A nil
+// lockedRand draws from the global source.
+type lockedRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) intn(n int) int {
+	if r == nil {
+		return rand.Intn(n)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Intn(n)
+}
+
+func (r *lockedRand) float64() float64 {
+	if r == nil {
+		return rand.Float64()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Float64()
+}
+
+func newAmnesiaMode(mode string, window, ttl time.Duration) (amnesiaMode, error) {
+	if window <= 0 {
+		window = defaultAmnesiaWindow
+	}
+	switch mode {
+	case "", AmnesiaRandom:
+		mode = AmnesiaRandom
+	case AmnesiaDeterministic:
+	case AmnesiaAgeWeighted:
+		if ttl <= 0 {
+			return amnesiaMode{}, fmt.Errorf("%w: amnesia-mode %q needs a ttl", ErrInvalidConfig, mode)
+		}
+	default:
+		return amnesiaMode{}, fmt.Errorf("%w: unknown amnesia-mode %q", ErrInvalidConfig, mode)
+	}
+	return amnesiaMode{mode: mode, window: window, ttl: ttl, now: time.Now}, nil
+}
+
+// forgetsKey reports whether a read of key falls through before the layer is
+// read. Age weighted amnesia is decided after the read by forgetsAge.
+func (cr *cache) forgetsKey(key string) bool {
+	if cr.amnesiaChance <= 0 {
+		return false
+	}
+	switch cr.amnesia.mode {
+	case AmnesiaDeterministic:
+		return deterministicChance(key, cr.amnesia.windowOf(key)) < cr.amnesiaChance
+	case AmnesiaAgeWeighted:
+		return cr.amnesiaChance >= 100
+	default:
+		return cr.amnesiaChance > cr.amnesia.random.intn(100)
+	}
+}
+
+// forgetsAge reports whether an entry of the given age falls through
+func (cr *cache) forgetsAge(age time.Duration) bool {
+	if cr.amnesia.mode != AmnesiaAgeWeighted || cr.amnesiaChance <= 0 {
+		return false
+	}
+	weight := min(float64(age)/float64(cr.amnesia.ttl), 1)
+	return cr.amnesia.random.float64()*100 < float64(cr.amnesiaChance)*weight
+}
+
+// windowOf returns the current window of key. Windows are shifted by a phase
+// derived from the key, so keys do not all change at the same instant.
+func (m amnesiaMode) windowOf(key string) int64 {
+	h := fnv.New64()
+	h.Write([]byte(key))
+	phase := int64(h.Sum64() % uint64(m.window))
+	return (m.now().UnixNano() + phase) / int64(m.window)
+}
+
+// deterministicChance maps key and window to a number in [0, 100)
+func deterministicChance(key string, window int64) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(window))
+	h.Write(buf[:])
+	return int(h.Sum64() % 100)
+}
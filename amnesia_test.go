@@ -0,0 +1,67 @@
+package mnemosyne
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeterministicAmnesia(t *testing.T) {
+	mode, err := newAmnesiaMode(AmnesiaDeterministic, 24*time.Hour, 0)
+	assert.NoError(t, err)
+	now := time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+	mode.now = func() time.Time { return now }
+	cr := &cache{amnesiaChance: 50, amnesia: mode}
+
+	keys := make([]string, 200)
+	forgotten := make(map[string]bool)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("amnesia_%d", i)
+		forgotten[keys[i]] = cr.forgetsKey(keys[i])
+	}
+	assert.Contains(t, forgotten, keys[0])
+
+	changed := func() int {
+		n := 0
+		for _, key := range keys {
+			if cr.forgetsKey(key) != forgotten[key] {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Zero(t, changed(), "amnesia changed within the same instant")
+
+	// midnight is not a window boundary for every key at once
+	now = now.Add(2 * time.Minute)
+	assert.Less(t, changed(), len(keys)/10)
+
+	// a whole window later every key is in a new window
+	now = now.Add(24 * time.Hour)
+	assert.Positive(t, changed())
+}
+
+func TestAgeWeightedAmnesia(t *testing.T) {
+	newLayer := func() *cache {
+		mode, err := newAmnesiaMode(AmnesiaAgeWeighted, 0, time.Hour)
+		assert.NoError(t, err)
+		mode.random = newLockedRand(42)
+		return &cache{amnesiaChance: 50, amnesia: mode}
+	}
+	first, second := newLayer(), newLayer()
+	forgotten := 0
+	for i := range 200 {
+		age := time.Duration(i) * time.Minute
+		forgets := first.forgetsAge(age)
+		assert.Equal(t, forgets, second.forgetsAge(age), "layers with the same seed should forget the same reads")
+		if forgets {
+			forgotten++
+		}
+	}
+	assert.Positive(t, forgotten)
+	assert.Less(t, forgotten, 200)
+	assert.False(t, first.forgetsKey("key"), "age weighted amnesia below 100 is decided after the read")
+	assert.False(t, first.forgetsAge(0))
+}
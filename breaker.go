@@ -0,0 +1,250 @@
+package mnemosyne
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+const (
+	defaultBreakerWindow   = 20
+	defaultBreakerCooldown = 5 * time.Second
+)
+
+// circuitBreaker stops calls to an unhealthy Redis layer. It opens when the
+// share of failed or slow calls among the last window calls reaches
+// errorRate, rejects calls for cooldown and then lets a single probe call
+// through: the breaker closes if the probe succeeds and opens again if not.
+// onChange is called after the breaker is unlocked, so it may inspect it.
+type circuitBreaker struct {
+	errorRate float64
+	slowCall  time.Duration
+	cooldown  time.Duration
+	onChange  func(from, to string)
+
+	mu       sync.Mutex
+	state    string
+	outcomes []bool
+	next     int
+	failures int
+	openedAt time.Time
+	probing  bool
+	// generation counts the state changes, so results of calls allowed
+	// before a change are told apart
+	generation uint64
+	changes    []breakerTransition
+}
+
+type breakerTransition struct {
+	from, to string
+}
+
+// breakerTicket identifies an allowed call when its result is recorded
+type breakerTicket struct {
+	generation uint64
+	probe      bool
+}
+
+// newCircuitBreaker reads the breaker of a layer from config and returns
+// nil if it is not enabled
+func newCircuitBreaker(config *viper.Viper, keyPrefix string, onChange func(from, to string)) (*circuitBreaker, error) {
+	errorRate := config.GetFloat64(keyPrefix + ".breaker-error-rate")
+	slowCall := config.GetDuration(keyPrefix + ".breaker-latency")
+	if errorRate == 0 && slowCall == 0 {
+		return nil, nil
+	}
+	window := defaultBreakerWindow
+	if config.IsSet(keyPrefix + ".breaker-window") {
+		window = config.GetInt(keyPrefix + ".breaker-window")
+	}
+	cooldown := defaultBreakerCooldown
+	if config.IsSet(keyPrefix + ".breaker-cooldown") {
+		cooldown = config.GetDuration(keyPrefix + ".breaker-cooldown")
+	}
+
+	switch {
+	case errorRate < 0 || errorRate > 1:
+		return nil, fmt.Errorf("%w: breaker-error-rate must be between 0 and 1, got %v", ErrInvalidConfig, errorRate)
+	case slowCall < 0:
+		return nil, fmt.Errorf("%w: breaker-latency must not be negative, got %v", ErrInvalidConfig, slowCall)
+	case window <= 0:
+		return nil, fmt.Errorf("%w: breaker-window must be positive, got %d", ErrInvalidConfig, window)
+	case cooldown <= 0:
+		return nil, fmt.Errorf("%w: breaker-cooldown must be positive, got %v", ErrInvalidConfig, cooldown)
+	}
+	if errorRate == 0 {
+		// only slow calls were configured, open once all recent calls are slow
+		errorRate = 1
+	}
+	return &circuitBreaker{
+		errorRate: errorRate,
+		slowCall:  slowCall,
+		cooldown:  cooldown,
+		onChange:  onChange,
+		state:     BreakerClosed,
+		outcomes:  make([]bool, 0, window),
+	}, nil
+}
+
+// allow reports whether a call may be made. Every allowed call must be
+// followed by record with the returned ticket. A nil breaker allows every
+// call.
+func (cb *circuitBreaker) allow() (breakerTicket, bool) {
+	if cb == nil {
+		return breakerTicket{}, true
+	}
+	cb.mu.Lock()
+	defer cb.unlock()
+	switch cb.state {
+	case BreakerOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return breakerTicket{}, false
+		}
+		cb.transition(BreakerHalfOpen)
+		cb.probing = true
+		return breakerTicket{generation: cb.generation, probe: true}, true
+	case BreakerHalfOpen:
+		if cb.probing {
+			return breakerTicket{}, false
+		}
+		cb.probing = true
+		return breakerTicket{generation: cb.generation, probe: true}, true
+	default:
+		return breakerTicket{generation: cb.generation}, true
+	}
+}
+
+// record reports the outcome of an allowed call. Only the probe decides a
+// half-open breaker, unless the caller cancelled it, and calls allowed
+// before the last state change are ignored.
+func (cb *circuitBreaker) record(ticket breakerTicket, err error, took time.Duration) {
+	if cb == nil {
+		return
+	}
+	failed := breakerFailure(err) || (cb.slowCall > 0 && took > cb.slowCall)
+
+	cb.mu.Lock()
+	defer cb.unlock()
+	if ticket.generation != cb.generation {
+		return
+	}
+	switch {
+	case ticket.probe && cb.state == BreakerHalfOpen:
+		cb.probing = false
+		if errors.Is(err, context.Canceled) {
+			// the probe never tested the server, the next call probes again
+			return
+		}
+		if failed {
+			cb.open()
+		} else {
+			cb.reset()
+			cb.transition(BreakerClosed)
+		}
+	case !ticket.probe && cb.state == BreakerClosed:
+		if len(cb.outcomes) < cap(cb.outcomes) {
+			cb.outcomes = append(cb.outcomes, failed)
+		} else {
+			if cb.outcomes[cb.next] {
+				cb.failures--
+			}
+			cb.outcomes[cb.next] = failed
+			cb.next = (cb.next + 1) % len(cb.outcomes)
+		}
+		if failed {
+			cb.failures++
+		}
+		if len(cb.outcomes) == cap(cb.outcomes) && float64(cb.failures) >= cb.errorRate*float64(len(cb.outcomes)) {
+			cb.open()
+		}
+	}
+}
+
+func (cb *circuitBreaker) open() {
+	cb.reset()
+	cb.openedAt = time.Now()
+	cb.transition(BreakerOpen)
+}
+
+func (cb *circuitBreaker) reset() {
+	cb.outcomes = cb.outcomes[:0]
+	cb.next = 0
+	cb.failures = 0
+}
+
+func (cb *circuitBreaker) transition(to string) {
+	from := cb.state
+	if from == to {
+		return
+	}
+	cb.state = to
+	cb.generation++
+	if cb.onChange != nil {
+		cb.changes = append(cb.changes, breakerTransition{from: from, to: to})
+	}
+}
+
+// unlock releases the breaker and then reports the state changes made
+// while it was held
+func (cb *circuitBreaker) unlock() {
+	changes := cb.changes
+	cb.changes = nil
+	cb.mu.Unlock()
+	for _, change := range changes {
+		cb.onChange(change.from, change.to)
+	}
+}
+
+func (cb *circuitBreaker) currentState() string {
+	if cb == nil {
+		return ""
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// breakerFailure reports whether err means the server is unhealthy. Misses
+// and calls cancelled by the caller are not failures.
+func breakerFailure(err error) bool {
+	return err != nil && !errors.Is(err, redis.Nil) && !errors.Is(err, context.Canceled)
+}
+
+// breakerChanged reports a state change of the layer's breaker
+func (cr *cache) breakerChanged(from, to string) {
+	entry := logrus.WithField("cache", cr.instanceName).
+		WithField("layer", cr.layerName).
+		WithField("from", from)
+	if to == BreakerOpen {
+		entry.Warnf("circuit breaker of layer %s opened", cr.layerName)
+	} else {
+		entry.Infof("circuit breaker of layer %s is %s", cr.layerName, to)
+	}
+	cr.observer.Observe(BreakerChange{Instance: cr.instanceName, Layer: cr.layerName, From: from, To: to})
+}
+
+// guarded runs call against the Redis server of the layer through its
+// circuit breaker
+func (cr *cache) guarded(call func() error) error {
+	ticket, ok := cr.breaker.allow()
+	if !ok {
+		return ErrCircuitOpen
+	}
+	startMarker := time.Now()
+	err := call()
+	cr.breaker.record(ticket, err, time.Since(startMarker))
+	return err
+}
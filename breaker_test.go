@@ -0,0 +1,92 @@
+package mnemosyne
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBreaker(t *testing.T, onChange func(from, to string)) *circuitBreaker {
+	t.Helper()
+	config := viper.New()
+	config.Set("layer.breaker-error-rate", 0.5)
+	config.Set("layer.breaker-window", 2)
+	config.Set("layer.breaker-cooldown", "10ms")
+	cb, err := newCircuitBreaker(config, "layer", onChange)
+	assert.NoError(t, err)
+	return cb
+}
+
+func TestBreakerObserverMayInspectIt(t *testing.T) {
+	var cb *circuitBreaker
+	var states []string
+	cb = newTestBreaker(t, func(from, to string) {
+		states = append(states, cb.currentState())
+	})
+	failure := errors.New("down")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 2 {
+			ticket, _ := cb.allow()
+			cb.record(ticket, failure, 0)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("breaker deadlocked while reporting a state change")
+	}
+	assert.Equal(t, []string{BreakerOpen}, states)
+}
+
+func TestBreakerOnlyProbeDecidesHalfOpen(t *testing.T) {
+	cb := newTestBreaker(t, nil)
+	failure := errors.New("down")
+
+	slow, ok := cb.allow()
+	assert.True(t, ok)
+	for range 2 {
+		ticket, _ := cb.allow()
+		cb.record(ticket, failure, 0)
+	}
+	assert.Equal(t, BreakerOpen, cb.currentState())
+
+	time.Sleep(20 * time.Millisecond)
+	probe, ok := cb.allow()
+	assert.True(t, ok)
+	assert.Equal(t, BreakerHalfOpen, cb.currentState())
+
+	// a call allowed while closed finishes after the breaker went half-open
+	cb.record(slow, nil, 0)
+	assert.Equal(t, BreakerHalfOpen, cb.currentState(), "only the probe should close the breaker")
+	_, ok = cb.allow()
+	assert.False(t, ok, "the probe is still running")
+
+	cb.record(probe, nil, 0)
+	assert.Equal(t, BreakerClosed, cb.currentState())
+}
+
+func TestBreakerCancelledProbeDecidesNothing(t *testing.T) {
+	cb := newTestBreaker(t, nil)
+	for range 2 {
+		ticket, _ := cb.allow()
+		cb.record(ticket, errors.New("down"), 0)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	probe, ok := cb.allow()
+	assert.True(t, ok)
+	cb.record(probe, context.Canceled, 0)
+	assert.Equal(t, BreakerHalfOpen, cb.currentState(), "a cancelled probe should not close the breaker")
+
+	probe, ok = cb.allow()
+	assert.True(t, ok, "the next call should probe again")
+	cb.record(probe, nil, 0)
+	assert.Equal(t, BreakerClosed, cb.currentState())
+}
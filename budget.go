@@ -0,0 +1,51 @@
+package mnemosyne
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// newInstanceTimeout reads the total time budget of an instance's operations
+func newInstanceTimeout(config *viper.Viper, configKeyPrefix string) (time.Duration, error) {
+	timeout := config.GetDuration(configKeyPrefix + ".timeout")
+	if timeout < 0 {
+		return 0, fmt.Errorf("%w: timeout must not be negative, got %v", ErrInvalidConfig, timeout)
+	}
+	return timeout, nil
+}
+
+// withBudget bounds ctx by the instance timeout, if one is configured
+func (mn *MnemosyneInstance) withBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	if mn.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, mn.timeout)
+}
+
+// layerContext returns the context for an operation on the i-th layer: an
+// equal share of the time left in ctx among the layers still to go, capped by
+// the layer's op-timeout. Time a layer does not use is left to the following
+// ones. ok is false if ctx has no time left.
+func (mn *MnemosyneInstance) layerContext(ctx context.Context, i int) (layerCtx context.Context, cancel context.CancelFunc, ok bool) {
+	if ctx.Err() != nil {
+		return ctx, func() {}, false
+	}
+	limit := mn.cacheLayers[i].opTimeout
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		share := time.Until(deadline) / time.Duration(len(mn.cacheLayers)-i)
+		if share <= 0 {
+			return ctx, func() {}, false
+		}
+		if limit <= 0 || share < limit {
+			limit = share
+		}
+	}
+	if limit <= 0 {
+		return ctx, func() {}, true
+	}
+	layerCtx, cancel = context.WithTimeout(ctx, limit)
+	return layerCtx, cancel, true
+}
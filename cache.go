@@ -2,11 +2,10 @@ package mnemosyne
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/allegro/bigcache/v3"
@@ -14,23 +13,45 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	errTinyMiss = errors.New("Failed to load from tiny store")
+	errExpired  = errors.New("entry expired")
+)
+
 type cache struct {
 	layerName          string
 	baseRedisClient    *redis.Client
-	slaveRedisClients  []*redis.Client
+	slaveRedisClients  *atomic.Pointer[[]*redis.Client]
+	discovery          *replicaDiscovery
+	recentWrites       *recentWrites
 	inMemCache         *bigcache.BigCache
-	syncmap            *sync.Map
+	memRemovals        *memoryRemovals
+	tiny               tinyStore
+	disk               *diskStore
+	janitor            *janitor
 	amnesiaChance      int
+	amnesia            amnesiaMode
+	breaker            *circuitBreaker
+	retry              *retryPolicy
+	hedge              *hedgePolicy
+	sizeLimit          *sizeLimit
 	compressionEnabled bool
+	legacyFormat       bool
+	corruptLog         *logSampler
 	cacheTTL           time.Duration
+	softTTL            time.Duration
+	opTimeout          time.Duration
 	ctx                context.Context
-	watcher            ITimer
+	instanceName       string
+	observer           Observer
+	tracer             Tracer
 }
 
-func newCacheRedis(layerName string, addr string, db int, TTL time.Duration, redisIdleTimeout, redisReadTimeout, redisWriteTimeout time.Duration, amnesiaChance int, compressionEnabled bool, watcher ITimer) *cache {
+func newRedisOptions(addr string, db int, redisIdleTimeout, redisReadTimeout, redisWriteTimeout time.Duration) *redis.Options {
 	redisOptions := &redis.Options{
-		Addr: addr,
-		DB:   db,
+		Addr:                  addr,
+		DB:                    db,
+		ContextTimeoutEnabled: true,
 	}
 	if redisIdleTimeout >= time.Second {
 		redisOptions.ConnMaxIdleTime = redisIdleTimeout
@@ -41,7 +62,11 @@ func newCacheRedis(layerName string, addr string, db int, TTL time.Duration, red
 	if redisWriteTimeout > 0 {
 		redisOptions.WriteTimeout = redisWriteTimeout
 	}
-	redisClient := redis.NewClient(redisOptions)
+	return redisOptions
+}
+
+func newCacheRedis(layerName string, addr string, db int, TTL time.Duration, redisIdleTimeout, redisReadTimeout, redisWriteTimeout time.Duration, amnesiaChance int, compressionEnabled bool) *cache {
+	redisClient := redis.NewClient(newRedisOptions(addr, db, redisIdleTimeout, redisReadTimeout, redisWriteTimeout))
 
 	ctx := context.TODO()
 	err := redisClient.Ping(ctx).Err()
@@ -55,32 +80,26 @@ func newCacheRedis(layerName string, addr string, db int, TTL time.Duration, red
 		compressionEnabled: compressionEnabled,
 		cacheTTL:           TTL,
 		ctx:                ctx,
-		watcher:            watcher,
 	}
 }
 
-func newCacheClusterRedis(layerName string, masterAddr string, slaveAddrs []string, db int, TTL time.Duration, redisIdleTimeout, redisReadTimeout, redisWriteTimeout time.Duration, amnesiaChance int, compressionEnabled bool, watcher ITimer) *cache {
+func newCacheClusterRedis(layerName string, masterAddr string, slaveAddrs []string, db int, TTL time.Duration, redisIdleTimeout, redisReadTimeout, redisWriteTimeout time.Duration, discoveryInterval time.Duration, writes *recentWrites, amnesiaChance int, compressionEnabled bool) *cache {
+	newSlaveClient := func(addr string) *redis.Client {
+		return redis.NewClient(newRedisOptions(addr, db, redisIdleTimeout, redisReadTimeout, redisWriteTimeout))
+	}
 	slaveClients := make([]*redis.Client, len(slaveAddrs))
+	seed := make(map[string]*redis.Client, len(slaveAddrs))
 	for i, addr := range slaveAddrs {
-		redisOptions := &redis.Options{
-			Addr: addr,
-			DB:   db,
-		}
-		if redisIdleTimeout >= time.Second {
-			redisOptions.ConnMaxIdleTime = redisIdleTimeout
-		}
-		if redisReadTimeout > 0 {
-			redisOptions.ReadTimeout = redisReadTimeout
-		}
-		if redisWriteTimeout > 0 {
-			redisOptions.WriteTimeout = redisWriteTimeout
-		}
-		slaveClients[i] = redis.NewClient(redisOptions)
+		slaveClients[i] = newSlaveClient(addr)
+		seed[addr] = slaveClients[i]
 	}
+	slaves := &atomic.Pointer[[]*redis.Client]{}
+	slaves.Store(&slaveClients)
 
 	redisOptions := &redis.Options{
-		Addr: masterAddr,
-		DB:   db,
+		Addr:                  masterAddr,
+		DB:                    db,
+		ContextTimeoutEnabled: true,
 	}
 	redisClient := redis.NewClient(redisOptions)
 
@@ -89,53 +108,60 @@ func newCacheClusterRedis(layerName string, masterAddr string, slaveAddrs []stri
 		logrus.WithError(err).Error("error while connecting to Redis Master")
 	}
 
+	var discovery *replicaDiscovery
+	if discoveryInterval > 0 {
+		discovery = newReplicaDiscovery(layerName, redisClient, slaves, seed, discoveryInterval, replicaRetireGrace, newSlaveClient)
+		go discovery.run()
+	}
+
 	return &cache{
 		layerName:          layerName,
 		baseRedisClient:    redisClient,
-		slaveRedisClients:  slaveClients,
+		slaveRedisClients:  slaves,
+		discovery:          discovery,
+		recentWrites:       writes,
 		amnesiaChance:      amnesiaChance,
 		compressionEnabled: compressionEnabled,
 		cacheTTL:           TTL,
 		ctx:                ctx,
-		watcher:            watcher,
 	}
 }
 
-func newCacheInMem(layerName string, maxMem int, TTL time.Duration, amnesiaChance int, compressionEnabled bool) *cache {
-	opts := bigcache.Config{
-		Shards:             1024,
-		LifeWindow:         TTL,
-		MaxEntriesInWindow: 1100 * 10 * 60,
-		MaxEntrySize:       500,
-		Verbose:            false,
-		HardMaxCacheSize:   maxMem,
-		CleanWindow:        1 * time.Minute,
-	}
+func newCacheInMem(layerName string, opts bigcache.Config, amnesiaChance int, compressionEnabled bool, evicted func(reason string)) (*cache, error) {
+	removals := &memoryRemovals{}
+	opts.OnRemoveWithReason = removals.onRemove(evicted)
 	ctx := context.TODO()
 	cacheInstance, err := bigcache.New(ctx, opts)
 	if err != nil {
-		logrus.Errorf("InMemCache Error: %v", err)
+		return nil, fmt.Errorf("InMemCache Error: %w", err)
 	}
 	return &cache{
 		layerName:          layerName,
 		inMemCache:         cacheInstance,
+		memRemovals:        removals,
 		amnesiaChance:      amnesiaChance,
 		compressionEnabled: compressionEnabled,
-		cacheTTL:           TTL,
+		cacheTTL:           opts.LifeWindow,
 		ctx:                ctx,
-	}
+	}, nil
 }
 
-func newCacheTiny(layerName string, amnesiaChance int, compressionEnabled bool) *cache {
-	data := sync.Map{}
-	return &cache{
+func newCacheTiny(layerName string, store tinyStore, TTL time.Duration, cleanupInterval time.Duration, amnesiaChance int, compressionEnabled bool) *cache {
+	cr := &cache{
 		layerName:          layerName,
-		syncmap:            &data,
+		tiny:               store,
 		amnesiaChance:      amnesiaChance,
 		compressionEnabled: compressionEnabled,
-		cacheTTL:           time.Hour * 9999,
+		cacheTTL:           TTL,
 		ctx:                context.TODO(),
 	}
+	if TTL > 0 {
+		if cleanupInterval <= 0 {
+			cleanupInterval = time.Minute
+		}
+		cr.janitor = startJanitor(cleanupInterval, cr.purgeExpired)
+	}
+	return cr
 }
 
 func (cr *cache) withContext(ctx context.Context) *cache {
@@ -143,151 +169,419 @@ func (cr *cache) withContext(ctx context.Context) *cache {
 		layerName:          cr.layerName,
 		baseRedisClient:    cr.baseRedisClient,
 		slaveRedisClients:  cr.slaveRedisClients,
+		discovery:          cr.discovery,
+		recentWrites:       cr.recentWrites,
 		inMemCache:         cr.inMemCache,
-		syncmap:            cr.syncmap,
+		memRemovals:        cr.memRemovals,
+		tiny:               cr.tiny,
+		disk:               cr.disk,
+		janitor:            cr.janitor,
 		amnesiaChance:      cr.amnesiaChance,
+		amnesia:            cr.amnesia,
+		breaker:            cr.breaker,
+		retry:              cr.retry,
+		hedge:              cr.hedge,
+		sizeLimit:          cr.sizeLimit,
 		compressionEnabled: cr.compressionEnabled,
+		legacyFormat:       cr.legacyFormat,
+		corruptLog:         cr.corruptLog,
 		cacheTTL:           cr.cacheTTL,
+		softTTL:            cr.softTTL,
+		opTimeout:          cr.opTimeout,
 		ctx:                ctx,
-		watcher:            cr.watcher,
+		instanceName:       cr.instanceName,
+		observer:           cr.observer,
+		tracer:             cr.tracer,
 	}
 }
 
-func (cr *cache) get(key string) (*cachableRet, error) {
-	if cr.amnesiaChance > rand.Intn(100) {
-		return nil, errors.New("Had Amnesia")
+func (cr *cache) get(key string) (value *cachableRet, err error) {
+	ctx, span := cr.startSpan(cr.ctx, "mnemosyne.layer.get", key)
+	defer func() {
+		span.SetAttributes(Attribute{Key: AttrResult, Value: outcome(err)})
+		span.End()
+	}()
+	if cr.forgetsKey(key) {
+		return nil, cr.hadAmnesia(span)
+	}
+	value, err = cr.load(ctx, span, key)
+	if err != nil {
+		return nil, err
 	}
+	if cr.forgetsAge(time.Since(value.Time)) {
+		return nil, cr.hadAmnesia(span)
+	}
+	return value, nil
+}
+
+func (cr *cache) hadAmnesia(span Span) error {
+	span.SetAttributes(Attribute{Key: AttrAmnesia, Value: true})
+	cr.observer.Observe(Amnesia{Instance: cr.instanceName, Layer: cr.layerName})
+	return errors.New("Had Amnesia")
+}
+
+// load reads and decodes the value stored for key. A value which cannot be
+// decoded is reported as a corrupt read rather than a hit.
+func (cr *cache) load(ctx context.Context, span Span, key string) (value *cachableRet, err error) {
 	var rawBytes []byte
-	var err error
-	if cr.syncmap != nil {
-		val, ok := cr.syncmap.Load(key)
-		if !ok {
-			err = errors.New("Failed to load from syncmap")
-		} else {
-			rawBytes, ok = val.([]byte)
-			if !ok {
-				err = errors.New("Failed to load from syncmap")
-			}
-		}
-	} else if cr.inMemCache != nil {
-		rawBytes, err = cr.inMemCache.Get(key)
-	} else {
-		var strValue string
-		client := cr.pickClient()
-		startMarker := cr.watcher.Start()
-		strValue, err = client.Get(cr.ctx, key).Result()
-		if err == nil {
-			cr.watcher.Done(startMarker, cr.layerName, "get", "ok")
-		} else if errors.Is(err, redis.Nil) {
-			cr.watcher.Done(startMarker, cr.layerName, "get", "miss")
-		} else {
-			cr.watcher.Done(startMarker, cr.layerName, "get", "error")
-		}
-		rawBytes = []byte(strValue)
+	startMarker := time.Now()
+	defer func() {
+		cr.observer.Observe(GetDone{
+			Instance: cr.instanceName,
+			Layer:    cr.layerName,
+			Result:   outcome(err),
+			Bytes:    len(rawBytes),
+			Err:      err,
+			Duration: time.Since(startMarker),
+		})
+	}()
+	if rawBytes, err = cr.fetch(ctx, key); err != nil {
+		return nil, err
 	}
-	if err != nil {
+	span.SetAttributes(Attribute{Key: AttrBytes, Value: len(rawBytes)})
+
+	_, decodeSpan := cr.tracer.Start(ctx, "mnemosyne.decode")
+	defer decodeSpan.End()
+	decodeSpan.SetAttributes(
+		Attribute{Key: AttrBytes, Value: len(rawBytes)},
+		Attribute{Key: AttrCompressed, Value: cr.compressionEnabled},
+	)
+	if value, err = cr.decode(rawBytes); err != nil {
+		cr.corrupted(key, err)
 		return nil, err
 	}
-	var finalBytes []byte
-	if cr.compressionEnabled {
-		finalBytes = DecompressZlib(rawBytes)
-	} else {
-		finalBytes = rawBytes
+	return value, nil
+}
+
+// fetch returns the bytes stored for key, as they were produced by set.
+// Unlike load it emits no GetDone event, for inspections and warm-ups which
+// must not be counted as traffic of the layer.
+func (cr *cache) fetch(ctx context.Context, key string) (rawBytes []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	var finalObject cachableRet
-	unmarshalErr := json.Unmarshal(finalBytes, &finalObject)
-	if unmarshalErr != nil {
-		return nil, fmt.Errorf("failed to unmarshall cached value : %v", unmarshalErr)
+	if cr.inProcess() {
+		entry, err := cr.loadEntry(key)
+		return entry.value, err
 	}
-	return &finalObject, nil
+	client := cr.pickClient(key)
+	// reads of pinned keys must stay on the master
+	hedged := cr.hedge != nil && !cr.recentWrites.pinned(key)
+	err = cr.redisCall(ctx, "get", func() error {
+		var strValue string
+		if hedged {
+			strValue, err = cr.hedgedGet(ctx, client, key)
+		} else {
+			strValue, err = client.Get(ctx, key).Result()
+		}
+		rawBytes = []byte(strValue)
+		return err
+	})
+	return rawBytes, err
+}
+
+func (cr *cache) set(key string, value interface{}) error {
+	return cr.write(key, value, false)
 }
 
-func (cr *cache) set(key string, value interface{}) (setError error) {
+// fill writes a value copied from a lower layer. Unlike set it does not pin
+// the key to the master, as nobody wrote a new value.
+func (cr *cache) fill(key string, value interface{}) error {
+	return cr.write(key, value, true)
+}
+
+func (cr *cache) write(key string, value interface{}, fill bool) (setError error) {
 	if cr.amnesiaChance == 100 {
 		return errors.New("Had Amnesia")
 	}
+	var finalData []byte
+	var skipped bool
+	startMarker := time.Now()
+	ctx, span := cr.startSpan(cr.ctx, "mnemosyne.layer.set", key)
+	defer func() {
+		span.SetAttributes(
+			Attribute{Key: AttrBytes, Value: len(finalData)},
+			Attribute{Key: AttrCompressed, Value: cr.compressionEnabled},
+			Attribute{Key: AttrResult, Value: outcome(setError)},
+		)
+		span.End()
+		if skipped {
+			return
+		}
+		cr.observer.Observe(SetDone{
+			Instance:   cr.instanceName,
+			Layer:      cr.layerName,
+			Bytes:      len(finalData),
+			Compressed: cr.compressionEnabled,
+			Err:        setError,
+			Duration:   time.Since(startMarker),
+		})
+	}()
 	defer func() {
 		if r := recover(); r != nil {
 			//json.Marshal panics under heavy-load which is not repeated with the same values
 			setError = fmt.Errorf("panic in cache-set: %v", r)
 		}
 	}()
-	rawData, err := json.Marshal(value)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, encodeSpan := cr.tracer.Start(ctx, "mnemosyne.encode")
+	finalData, err := cr.encode(value)
 	if err != nil {
+		encodeSpan.End()
 		return err
 	}
-	var finalData []byte
-	if cr.compressionEnabled {
-		finalData = CompressZlib(rawData)
-	} else {
-		finalData = rawData
+	encodeSpan.SetAttributes(
+		Attribute{Key: AttrBytes, Value: len(finalData)},
+		Attribute{Key: AttrCompressed, Value: cr.compressionEnabled},
+	)
+	encodeSpan.End()
+	if cr.sizeLimit.exceeds(len(finalData)) {
+		if fill {
+			// the key missed in this layer, there is no stale value to remove
+			skipped = true
+			return errTooLargeToFill
+		}
+		err := cr.oversized(ctx, key, len(finalData))
+		skipped = err == nil
+		return err
 	}
-	if cr.syncmap != nil {
-		cr.syncmap.Store(key, finalData)
+	if cr.disk != nil {
+		return cr.disk.store(key, newMemEntry(finalData, cr.cacheTTL))
+	} else if cr.tiny != nil {
+		entry := newMemEntry(finalData, cr.cacheTTL)
+		cr.tiny.store(key, &entry)
 		return nil
 	} else if cr.inMemCache != nil {
-		return cr.inMemCache.Set(key, finalData)
+		return cr.inMemCache.Set(key, newMemEntry(finalData, cr.cacheTTL).encode())
 	}
 	client := cr.baseRedisClient
-	startMarker := cr.watcher.Start()
-	setError = client.Set(cr.ctx, key, finalData, cr.cacheTTL).Err()
-	if setError != nil {
-		cr.watcher.Done(startMarker, cr.layerName, "set", "error")
-	} else {
-		cr.watcher.Done(startMarker, cr.layerName, "set", "ok")
-	}
-	return
+	return cr.redisCall(ctx, "set", func() error {
+		if cr.recentWrites != nil && !fill {
+			return cr.recentWrites.set(ctx, client, key, finalData, cr.cacheTTL, len(cr.slaves()))
+		}
+		return client.Set(ctx, key, finalData, cr.cacheTTL).Err()
+	})
 }
 
-func (cr *cache) delete(ctx context.Context, key string) error {
+func (cr *cache) delete(ctx context.Context, key string) (err error) {
 	if cr.amnesiaChance == 100 {
 		return errors.New("Had Amnesia")
 	}
-	if cr.syncmap != nil {
-		cr.syncmap.Delete(key)
+	defer cr.observeOp("delete", time.Now(), &err)
+	ctx, span := cr.startSpan(ctx, "mnemosyne.layer.delete", key)
+	defer func() {
+		span.SetAttributes(Attribute{Key: AttrResult, Value: outcome(err)})
+		span.End()
+	}()
+	if cr.disk != nil {
+		return cr.disk.remove(key)
+	} else if cr.tiny != nil {
+		cr.tiny.remove(key)
 		return nil
 	} else if cr.inMemCache != nil {
-		return cr.inMemCache.Delete(key)
+		// like Redis DEL, deleting a missing key is not an error
+		if err := cr.inMemCache.Delete(key); !errors.Is(err, bigcache.ErrEntryNotFound) {
+			return err
+		}
+		return nil
 	}
+	cr.recentWrites.record(key)
 	client := cr.baseRedisClient
-	err := client.Del(ctx, key).Err()
-	return err
+	return cr.redisCall(ctx, "delete", func() error {
+		return client.Del(ctx, key).Err()
+	})
 }
 
-func (cr *cache) clear() error {
+func (cr *cache) clear() (err error) {
 	if cr.amnesiaChance == 100 {
 		return errors.New("Had Amnesia")
 	}
-	if cr.syncmap != nil {
-		cr.syncmap = &sync.Map{}
+	defer cr.observeOp("clear", time.Now(), &err)
+	if cr.disk != nil {
+		return cr.disk.clear()
+	} else if cr.tiny != nil {
+		cr.tiny.clear()
 		return nil
 	} else if cr.inMemCache != nil {
 		return cr.inMemCache.Reset()
 	}
+	ctx := cr.ctx
+	if cr.opTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cr.opTimeout)
+		defer cancel()
+	}
 	client := cr.baseRedisClient
-	err := client.FlushDB(cr.ctx).Err()
-	return err
+	return cr.redisCall(ctx, "clear", func() error {
+		return client.FlushDB(ctx).Err()
+	})
 }
 
 func (cr *cache) getTTL(key string) time.Duration {
-	if cr.inMemCache != nil || cr.syncmap != nil {
-		return time.Second * 0
+	startMarker := time.Now()
+	ttl, err := cr.remainingTTL(key)
+	cr.observeOp("ttl", startMarker, &err)
+	return ttl
+}
+
+// remainingTTL is getTTL without the OpDone event, it returns 0 with the
+// error of a failed or missed lookup
+func (cr *cache) remainingTTL(key string) (time.Duration, error) {
+	if cr.inProcess() {
+		entry, err := cr.loadEntry(key)
+		if err != nil {
+			return 0, err
+		}
+		return entry.ttl(time.Now()), nil
+	}
+	client := cr.pickClient(key)
+	var res time.Duration
+	err := cr.guarded(func() (err error) {
+		res, err = client.TTL(cr.ctx, key).Result()
+		return err
+	})
+	// Redis answers -2 rather than nil for a missing key
+	if err == nil && res == -2 {
+		err = redis.Nil
 	}
-	client := cr.pickClient()
-	res, err := client.TTL(cr.ctx, key).Result()
 	if err != nil {
-		return time.Second * 0
+		return 0, err
 	}
-	return res
+	return res, nil
+}
+
+func (cr *cache) observeOp(op string, startMarker time.Time, err *error) {
+	cr.observer.Observe(OpDone{
+		Instance: cr.instanceName,
+		Layer:    cr.layerName,
+		Op:       op,
+		Result:   outcome(*err),
+		Err:      *err,
+		Duration: time.Since(startMarker),
+	})
+}
+
+// outcome classifies the error of a layer operation as "ok", "miss",
+// "corrupt" or "error"
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, redis.Nil), errors.Is(err, bigcache.ErrEntryNotFound), errors.Is(err, errTinyMiss), errors.Is(err, errDiskMiss), errors.Is(err, errExpired):
+		return "miss"
+	case errors.Is(err, errCorruptEntry), errors.Is(err, errUnknownFormat):
+		return "corrupt"
+	default:
+		return "error"
+	}
+}
+
+// inProcess reports whether the layer is stored by this process rather than
+// by Redis
+func (cr *cache) inProcess() bool {
+	return cr.tiny != nil || cr.inMemCache != nil || cr.disk != nil
 }
 
-func (cr *cache) pickClient() *redis.Client {
-	if len(cr.slaveRedisClients) == 0 {
+// loadEntry reads key from an in-process layer, lazily removing it if it has
+// already expired
+func (cr *cache) loadEntry(key string) (memEntry, error) {
+	if cr.disk != nil {
+		return cr.disk.load(key)
+	}
+	var entry memEntry
+	var stored *memEntry
+	if cr.tiny != nil {
+		var ok bool
+		stored, ok = cr.tiny.load(key)
+		if !ok {
+			return entry, errTinyMiss
+		}
+		entry = *stored
+	} else {
+		rawBytes, err := cr.inMemCache.Get(key)
+		if err != nil {
+			return entry, err
+		}
+		if entry, err = decodeMemEntry(rawBytes); err != nil {
+			return entry, err
+		}
+	}
+	if entry.expired(time.Now()) {
+		if cr.tiny != nil {
+			cr.tiny.removeIf(key, stored)
+		} else {
+			_ = cr.inMemCache.Delete(key)
+		}
+		return memEntry{}, errExpired
+	}
+	return entry, nil
+}
+
+// purgeExpired removes all expired entries from a tiny layer
+func (cr *cache) purgeExpired() {
+	now := time.Now()
+	cr.tiny.each(func(key string, entry *memEntry) bool {
+		if entry.expired(now) {
+			cr.tiny.removeIf(key, entry)
+		}
+		return true
+	})
+}
+
+// pickClient returns the client to read key from, pinning recently written
+// keys to the master when read-your-writes is enabled
+func (cr *cache) pickClient(key string) *redis.Client {
+	if cr.recentWrites.pinned(key) {
 		return cr.baseRedisClient
 	}
-	cl := rand.Intn(len(cr.slaveRedisClients) + 1)
+	slaves := cr.slaves()
+	if len(slaves) == 0 {
+		return cr.baseRedisClient
+	}
+	cl := rand.Intn(len(slaves) + 1)
 	if cl == 0 {
 		return cr.baseRedisClient
 	}
-	return cr.slaveRedisClients[cl-1]
+	return slaves[cl-1]
+}
+
+// slaves returns the current slave clients of a guardian layer
+func (cr *cache) slaves() []*redis.Client {
+	if cr.slaveRedisClients == nil {
+		return nil
+	}
+	if loaded := cr.slaveRedisClients.Load(); loaded != nil {
+		return *loaded
+	}
+	return nil
+}
+
+// close stops background work of the layer and releases its connections
+func (cr *cache) close() error {
+	if cr.discovery != nil {
+		cr.discovery.close()
+	}
+	if cr.janitor != nil {
+		cr.janitor.close()
+	}
+	if cr.disk != nil {
+		cr.disk.close()
+	}
+	var errs []error
+	if cr.slaveRedisClients != nil {
+		if slaves := cr.slaveRedisClients.Load(); slaves != nil {
+			for _, client := range *slaves {
+				errs = append(errs, client.Close())
+			}
+		}
+	}
+	if cr.baseRedisClient != nil {
+		errs = append(errs, cr.baseRedisClient.Close())
+	}
+	if cr.inMemCache != nil {
+		errs = append(errs, cr.inMemCache.Close())
+	}
+	return errors.Join(errs...)
 }
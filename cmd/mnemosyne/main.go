@@ -0,0 +1,295 @@
+// Command mnemosyne inspects and manages the cache instances described by a
+// Mnemosyne configuration file.
+//
+// Usage:
+//
+//	mnemosyne -config config.yaml -instance NAME [-layer LAYER] COMMAND [ARGS]
+//
+// Commands:
+//
+//	get KEY           show the decoded value of KEY in each layer (or in -layer)
+//	ttl KEY           show the remaining TTL of KEY in each layer (or in -layer)
+//	set KEY JSON      set KEY to the JSON value in all layers, not with -layer
+//	delete KEY        delete KEY from all layers, not with -layer
+//	scan [PATTERN]    list the keys of -layer matching PATTERN
+//	flush             remove every key of -layer, requires -yes
+//
+// Memory and tiny layers live inside each service process, so the command
+// leaves them out and refuses them as -layer. Disk layers are used only if
+// their directory already exists, that is when the command runs where the
+// service keeps it.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cafebazaar/mnemosyne"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var errUsage = errors.New("usage error")
+
+type options struct {
+	instance string
+	layer    string
+	yes      bool
+	out      io.Writer
+}
+
+func main() {
+	configPath := flag.String("config", "", "path to the configuration file (required)")
+	instanceName := flag.String("instance", "", "name of the cache instance (required)")
+	layer := flag.String("layer", "", "name of the layer to operate on")
+	yes := flag.Bool("yes", false, "confirm destructive commands")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of the command")
+	verbose := flag.Bool("v", false, "log cache internals")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -config FILE -instance NAME [-layer LAYER] COMMAND [ARGS]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Commands: get KEY, ttl KEY, set KEY JSON, delete KEY, scan [PATTERN], flush")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if !*verbose {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+	if *configPath == "" || *instanceName == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config := viper.New()
+	config.SetConfigFile(*configPath)
+	if err := config.ReadInConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read config: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	opts := options{
+		instance: *instanceName,
+		layer:    *layer,
+		yes:      *yes,
+		out:      os.Stdout,
+	}
+	err := run(ctx, config, opts, flag.Args())
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, config *viper.Viper, opts options, args []string) error {
+	if !config.IsSet("cache." + opts.instance) {
+		return fmt.Errorf("cache instance %q not found in config", opts.instance)
+	}
+	single, skipped := instanceConfig(config, opts.instance)
+	if reason, ok := skipped[opts.layer]; ok {
+		return fmt.Errorf("layer %q %s, the command cannot see what the service cached in it", opts.layer, reason)
+	}
+	if len(single.GetStringSlice("cache."+opts.instance+".layers")) == 0 && len(skipped) > 0 {
+		return fmt.Errorf("cache instance %q has no layer shared with the service", opts.instance)
+	}
+	manager, err := newManager(single)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+	instance := manager.Select(opts.instance)
+
+	if opts.layer != "" {
+		found := false
+		for _, layer := range instance.Layers() {
+			found = found || layer.Name == opts.layer
+		}
+		if !found {
+			return fmt.Errorf("%w: %s", mnemosyne.ErrLayerNotFound, opts.layer)
+		}
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: get takes a key", errUsage)
+		}
+		return get(ctx, instance, opts, args[0])
+	case "ttl":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: ttl takes a key", errUsage)
+		}
+		return ttl(ctx, instance, opts, args[0])
+	case "set":
+		if opts.layer != "" {
+			return fmt.Errorf("%w: set writes all layers and does not take -layer", errUsage)
+		}
+		if len(args) != 2 {
+			return fmt.Errorf("%w: set takes a key and a JSON value", errUsage)
+		}
+		if !json.Valid([]byte(args[1])) {
+			return fmt.Errorf("value is not valid JSON: %s", args[1])
+		}
+		return instance.Set(ctx, args[0], json.RawMessage(args[1]))
+	case "delete":
+		if opts.layer != "" {
+			return fmt.Errorf("%w: delete removes the key from all layers and does not take -layer", errUsage)
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("%w: delete takes a key", errUsage)
+		}
+		return instance.Delete(ctx, args[0])
+	case "scan":
+		if opts.layer == "" || len(args) > 1 {
+			return fmt.Errorf("%w: scan needs -layer and takes an optional pattern", errUsage)
+		}
+		pattern := ""
+		if len(args) == 1 {
+			pattern = args[0]
+		}
+		for key, err := range instance.Keys(ctx, opts.layer, pattern) {
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(opts.out, key)
+		}
+		return nil
+	case "flush":
+		if opts.layer == "" || len(args) != 0 {
+			return fmt.Errorf("%w: flush needs -layer", errUsage)
+		}
+		if !opts.yes {
+			return fmt.Errorf("refusing to flush layer %q without -yes", opts.layer)
+		}
+		return instance.Flush(opts.layer)
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, command)
+	}
+}
+
+// newManager builds the cache manager, returning the configuration errors
+// NewMnemosyne panics with as an error
+func newManager(config *viper.Viper) (manager *mnemosyne.Mnemosyne, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if entry, ok := r.(*logrus.Entry); ok {
+				r = entry.Message
+			}
+			err = fmt.Errorf("failed to build cache instance: %v", r)
+		}
+	}()
+	return mnemosyne.NewMnemosyne(config, nil, nil), nil
+}
+
+// instanceConfig returns the config of instance alone, so broken neighbours
+// do not matter, without the startup and shutdown work meant for the service:
+// a one-off command should not scan the source layer to warm memory it throws
+// away, nor restore the service's snapshot and overwrite it on exit.
+//
+// Layers the command does not share with the service are left out too, and
+// returned in skipped with the reason.
+func instanceConfig(config *viper.Viper, instance string) (single *viper.Viper, skipped map[string]string) {
+	settings := maps.Clone(config.GetStringMap("cache." + instance))
+	delete(settings, "warm")
+	delete(settings, "snapshot-file")
+	single = viper.New()
+	single.Set("cache."+instance, settings)
+
+	skipped = make(map[string]string)
+	layers := single.GetStringSlice("cache." + instance + ".layers")
+	for _, layer := range layers {
+		keyPrefix := "cache." + instance + "." + layer
+		switch layerType := single.GetString(keyPrefix + ".type"); layerType {
+		case "memory", "tiny":
+			skipped[layer] = fmt.Sprintf("is a %s layer held in the memory of each process", layerType)
+		case "disk":
+			dir := single.GetString(keyPrefix + ".directory")
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				skipped[layer] = fmt.Sprintf("is a disk layer whose directory %q does not exist on this machine", dir)
+			}
+		}
+	}
+	if len(skipped) > 0 {
+		single.Set("cache."+instance+".layers", slices.DeleteFunc(slices.Clone(layers), func(layer string) bool {
+			_, ok := skipped[layer]
+			return ok
+		}))
+	}
+	return single, skipped
+}
+
+func selected(opts options, entries []mnemosyne.LayerEntry) []mnemosyne.LayerEntry {
+	if opts.layer == "" {
+		return entries
+	}
+	for _, entry := range entries {
+		if entry.Layer == opts.layer {
+			return []mnemosyne.LayerEntry{entry}
+		}
+	}
+	return nil
+}
+
+func get(ctx context.Context, instance *mnemosyne.MnemosyneInstance, opts options, key string) error {
+	found := false
+	for _, entry := range selected(opts, instance.Inspect(ctx, key)) {
+		if !entry.Present && entry.Error != "" {
+			fmt.Fprintf(opts.out, "# %s: failed: %s\n", entry.Layer, entry.Error)
+			continue
+		} else if !entry.Present {
+			fmt.Fprintf(opts.out, "# %s: not found\n", entry.Layer)
+			continue
+		}
+		found = true
+		if entry.Error != "" {
+			fmt.Fprintf(opts.out, "# %s: %d bytes, undecodable: %s\n", entry.Layer, entry.Size, entry.Error)
+			continue
+		}
+		fmt.Fprintf(opts.out, "# %s: %d bytes, cached at %s (age %s), ttl %s\n",
+			entry.Layer, entry.Size, entry.CachedAt.Format(time.RFC3339), entry.Age.Round(time.Second), entry.TTL.Round(time.Second))
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, entry.Value, "", "  "); err != nil {
+			pretty.Reset()
+			pretty.Write(entry.Value)
+		}
+		fmt.Fprintln(opts.out, pretty.String())
+	}
+	if !found {
+		return mnemosyne.ErrNotFound
+	}
+	return nil
+}
+
+func ttl(ctx context.Context, instance *mnemosyne.MnemosyneInstance, opts options, key string) error {
+	w := tabwriter.NewWriter(opts.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tPRESENT\tTTL")
+	for _, entry := range selected(opts, instance.Inspect(ctx, key)) {
+		ttl := "-"
+		if entry.Present {
+			ttl = entry.TTL.String()
+		}
+		fmt.Fprintf(w, "%s\t%t\t%s\n", entry.Layer, entry.Present, ttl)
+	}
+	return w.Flush()
+}
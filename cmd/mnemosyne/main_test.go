@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/cafebazaar/mnemosyne"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestConfig(t *testing.T) (*viper.Viper, *miniredis.Miniredis) {
+	logrus.SetLevel(logrus.WarnLevel)
+	redisServer := miniredis.RunT(t)
+	config := viper.New()
+	config.Set("cache.result.soft-ttl", "1h")
+	config.Set("cache.result.layers", []string{"result-memory", "result-redis"})
+	config.Set("cache.result.result-memory.type", "memory")
+	config.Set("cache.result.result-memory.ttl", "1h")
+	config.Set("cache.result.result-redis.type", "redis")
+	config.Set("cache.result.result-redis.address", redisServer.Addr())
+	config.Set("cache.result.result-redis.ttl", "2h")
+	return config, redisServer
+}
+
+func runCommand(t *testing.T, config *viper.Viper, opts options, args ...string) (string, error) {
+	var out bytes.Buffer
+	opts.instance = "result"
+	opts.out = &out
+	err := run(context.Background(), config, opts, args)
+	return out.String(), err
+}
+
+func TestSetGetAndTTL(t *testing.T) {
+	config, redisServer := newTestConfig(t)
+
+	_, err := runCommand(t, config, options{}, "set", "user:1", `{"name":"cli"}`)
+	assert.NoError(t, err)
+	assert.True(t, redisServer.Exists("user:1"))
+
+	out, err := runCommand(t, config, options{}, "get", "user:1")
+	assert.NoError(t, err)
+	assert.NotContains(t, out, "result-memory", "memory layers are not shared with the service")
+	assert.Contains(t, out, "# result-redis: ")
+	assert.Contains(t, out, `"name": "cli"`)
+
+	out, err = runCommand(t, config, options{layer: "result-redis"}, "ttl", "user:1")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "result-redis")
+	assert.Contains(t, out, "true")
+	assert.Contains(t, out, "2h0m0s")
+	assert.NotContains(t, out, "result-memory")
+
+	_, err = runCommand(t, config, options{}, "get", "missing")
+	assert.ErrorIs(t, err, mnemosyne.ErrNotFound)
+	_, err = runCommand(t, config, options{}, "set", "user:2", "{not json")
+	assert.Error(t, err)
+	assert.False(t, redisServer.Exists("user:2"))
+
+	_, err = runCommand(t, config, options{}, "delete", "user:1")
+	assert.NoError(t, err)
+	assert.False(t, redisServer.Exists("user:1"))
+}
+
+func TestScanAndFlush(t *testing.T) {
+	config, redisServer := newTestConfig(t)
+	for _, key := range []string{"user:1", "user:2", "order:1"} {
+		assert.NoError(t, redisServer.Set(key, "{}"))
+	}
+
+	out, err := runCommand(t, config, options{layer: "result-redis"}, "scan", "user:*")
+	assert.NoError(t, err)
+	keys := strings.Fields(out)
+	assert.ElementsMatch(t, []string{"user:1", "user:2"}, keys)
+
+	_, err = runCommand(t, config, options{layer: "result-redis"}, "flush")
+	assert.ErrorContains(t, err, "without -yes")
+	assert.Len(t, redisServer.Keys(), 3, "flush without -yes must not remove anything")
+
+	_, err = runCommand(t, config, options{layer: "result-redis", yes: true}, "flush")
+	assert.NoError(t, err)
+	assert.Empty(t, redisServer.Keys())
+}
+
+func TestUsageErrors(t *testing.T) {
+	config, _ := newTestConfig(t)
+	for _, args := range [][]string{
+		{"get"},
+		{"set", "key"},
+		{"scan"},
+		{"flush"},
+		{"frobnicate"},
+	} {
+		_, err := runCommand(t, config, options{yes: true}, args...)
+		assert.ErrorIs(t, err, errUsage, "%v", args)
+	}
+	_, err := runCommand(t, config, options{layer: "nope"}, "scan")
+	assert.ErrorIs(t, err, mnemosyne.ErrLayerNotFound)
+
+	err = run(context.Background(), config, options{instance: "nope"}, []string{"get", "key"})
+	assert.ErrorContains(t, err, "not found in config")
+}
+
+func TestInstanceConfigSkipsServiceHooks(t *testing.T) {
+	config, redisServer := newTestConfig(t)
+	snapshotFile := filepath.Join(t.TempDir(), "result.snapshot")
+	config.Set("cache.result.warm.pattern", "*")
+	config.Set("cache.result.snapshot-file", snapshotFile)
+	config.Set("cache.other.soft-ttl", "1h")
+
+	single, _ := instanceConfig(config, "result")
+	assert.False(t, single.IsSet("cache.result.warm"), "one-off commands should not warm the instance")
+	assert.False(t, single.IsSet("cache.result.snapshot-file"), "one-off commands should not touch the service's snapshot")
+	assert.False(t, single.IsSet("cache.other"))
+	assert.Equal(t, []string{"result-redis"}, single.GetStringSlice("cache.result.layers"))
+	assert.True(t, config.IsSet("cache.result.warm"), "the original config should be left alone")
+
+	assert.NoError(t, redisServer.Set("user:1", "{}"))
+	_, err := runCommand(t, config, options{}, "delete", "user:1")
+	assert.NoError(t, err)
+	assert.False(t, redisServer.Exists("user:1"))
+	assert.NoFileExists(t, snapshotFile, "the command wrote a snapshot on exit")
+}
+
+func TestLayerOnlyCommands(t *testing.T) {
+	config, redisServer := newTestConfig(t)
+	assert.NoError(t, redisServer.Set("user:1", "{}"))
+
+	_, err := runCommand(t, config, options{layer: "result-redis"}, "delete", "user:1")
+	assert.ErrorIs(t, err, errUsage)
+	assert.True(t, redisServer.Exists("user:1"), "delete with -layer should not touch other layers")
+	_, err = runCommand(t, config, options{layer: "result-redis"}, "set", "user:2", "{}")
+	assert.ErrorIs(t, err, errUsage)
+	assert.False(t, redisServer.Exists("user:2"))
+}
+
+func TestUnsharedLayers(t *testing.T) {
+	config, redisServer := newTestConfig(t)
+	assert.NoError(t, redisServer.Set("user:1", "{}"))
+
+	for _, args := range [][]string{{"get", "user:1"}, {"scan"}, {"flush"}} {
+		_, err := runCommand(t, config, options{layer: "result-memory", yes: true}, args...)
+		assert.ErrorContains(t, err, "held in the memory of each process", "%v", args)
+	}
+	assert.True(t, redisServer.Exists("user:1"))
+
+	config.Set("cache.result.layers", []string{"result-memory"})
+	_, err := runCommand(t, config, options{}, "delete", "user:1")
+	assert.ErrorContains(t, err, "no layer shared with the service")
+
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing")
+	config.Set("cache.result.layers", []string{"result-disk"})
+	config.Set("cache.result.result-disk.type", "disk")
+	config.Set("cache.result.result-disk.directory", missing)
+	config.Set("cache.result.result-disk.ttl", "1h")
+	_, err = runCommand(t, config, options{}, "set", "user:1", "{}")
+	assert.ErrorContains(t, err, "no layer shared with the service")
+	assert.NoDirExists(t, missing, "the command should not create a disk layer the service does not use")
+
+	config.Set("cache.result.result-disk.directory", dir)
+	_, err = runCommand(t, config, options{}, "set", "user:1", `{"name":"disk"}`)
+	assert.NoError(t, err)
+	out, err := runCommand(t, config, options{layer: "result-disk"}, "get", "user:1")
+	assert.NoError(t, err)
+	assert.Contains(t, out, `"name": "disk"`, "a later run should read what the first wrote to the shared directory")
+}
+
+func TestBrokenConfig(t *testing.T) {
+	config, _ := newTestConfig(t)
+	config.Set("cache.result.soft-ttl", "0s")
+	var err error
+	assert.NotPanics(t, func() {
+		_, err = runCommand(t, config, options{}, "get", "user:1")
+	})
+	assert.ErrorContains(t, err, "no valid cache instances")
+}
@@ -0,0 +1,129 @@
+package mnemosyne
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultWaitTimeout = 10 * time.Millisecond
+
+// recentWrites remembers the keys recently written through a guardian layer
+// so that reads of them are pinned to the master until the replicas are
+// expected to have caught up
+type recentWrites struct {
+	window       time.Duration
+	waitReplicas int
+	waitTimeout  time.Duration
+
+	mu         sync.Mutex
+	pins       map[string]pin
+	generation uint64
+	lastPurge  time.Time
+}
+
+// pin keeps reads of a key on the master until deadline. generation tells
+// the write which set it apart from later writes of the same key.
+type pin struct {
+	deadline   time.Time
+	generation uint64
+}
+
+// newRecentWrites returns nil when read-your-writes is disabled
+func newRecentWrites(window time.Duration, waitReplicas int, waitTimeout time.Duration) *recentWrites {
+	if window <= 0 {
+		return nil
+	}
+	if waitTimeout <= 0 {
+		// WAIT with a zero timeout blocks forever
+		waitTimeout = defaultWaitTimeout
+	}
+	return &recentWrites{
+		window:       window,
+		waitReplicas: waitReplicas,
+		waitTimeout:  waitTimeout,
+		pins:         make(map[string]pin),
+		lastPurge:    time.Now(),
+	}
+}
+
+// record pins key for a write and returns the generation of the pin
+func (rw *recentWrites) record(key string) uint64 {
+	if rw == nil {
+		return 0
+	}
+	now := time.Now()
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.generation++
+	rw.pins[key] = pin{deadline: now.Add(rw.window), generation: rw.generation}
+	if now.Sub(rw.lastPurge) > rw.window {
+		for k, p := range rw.pins {
+			if now.After(p.deadline) {
+				delete(rw.pins, k)
+			}
+		}
+		rw.lastPurge = now
+	}
+	return rw.generation
+}
+
+// forget unpins key, unless it was pinned again by a later write
+func (rw *recentWrites) forget(key string, generation uint64) {
+	if rw == nil {
+		return
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if p, ok := rw.pins[key]; ok && p.generation == generation {
+		delete(rw.pins, key)
+	}
+}
+
+func (rw *recentWrites) pinned(key string) bool {
+	if rw == nil {
+		return false
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	p, ok := rw.pins[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(p.deadline) {
+		delete(rw.pins, key)
+		return false
+	}
+	return true
+}
+
+// set writes the value on the master and, when configured, waits for the
+// replicas to acknowledge it. WAIT does not tell which replicas acknowledged,
+// so the key stays pinned to the master unless all of the replicas the layer
+// reads from did.
+func (rw *recentWrites) set(ctx context.Context, client *redis.Client, key string, value []byte, ttl time.Duration, replicas int) error {
+	generation := rw.record(key)
+	if rw.waitReplicas <= 0 {
+		return client.Set(ctx, key, value, ttl).Err()
+	}
+	waitFor := max(rw.waitReplicas, replicas)
+
+	// WAIT only covers writes made on the same connection, so both commands
+	// have to go through a single pipeline
+	var set *redis.StatusCmd
+	var wait *redis.Cmd
+	_, _ = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		set = pipe.Set(ctx, key, value, ttl)
+		wait = pipe.Do(ctx, "wait", waitFor, rw.waitTimeout.Milliseconds())
+		return nil
+	})
+	if err := set.Err(); err != nil {
+		return err
+	}
+	if acked, err := wait.Int64(); err == nil && acked >= int64(waitFor) {
+		rw.forget(key, generation)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package mnemosyne
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentWritesGenerations(t *testing.T) {
+	rw := newRecentWrites(time.Minute, 0, 0)
+	first := rw.record("key")
+	second := rw.record("key")
+	rw.forget("key", first)
+	assert.True(t, rw.pinned("key"), "an ack of an older write must not unpin a newer one")
+	rw.forget("key", second)
+	assert.False(t, rw.pinned("key"))
+
+	short := newRecentWrites(10*time.Millisecond, 0, 0)
+	short.record("key")
+	assert.True(t, short.pinned("key"))
+	assert.Eventually(t, func() bool { return !short.pinned("key") }, time.Second, 5*time.Millisecond)
+
+	var disabled *recentWrites
+	assert.Zero(t, disabled.record("key"))
+	assert.False(t, disabled.pinned("key"))
+}
+
+func TestReadYourWritesPinning(t *testing.T) {
+	master, slave := miniredis.RunT(t), miniredis.RunT(t)
+	// miniredis does not implement WAIT, so writes are never confirmed
+	writes := newRecentWrites(time.Minute, 1, 0)
+	cr := newCacheClusterRedis("guardian", master.Addr(), []string{slave.Addr()}, 0, time.Hour, 0, 0, 0, 0, writes, 0, false)
+	cr.observer = combineObservers()
+	cr.tracer = noopTracer{}
+	t.Cleanup(func() { _ = cr.close() })
+
+	assert.NoError(t, cr.set("written", cachable{CachedObject: "value", Time: time.Now()}))
+	assert.True(t, writes.pinned("written"), "unconfirmed writes should be pinned")
+	for range 20 {
+		assert.Same(t, cr.baseRedisClient, cr.pickClient("written"))
+	}
+
+	assert.NoError(t, cr.fill("filled", cachable{CachedObject: "value", Time: time.Now()}))
+	assert.False(t, writes.pinned("filled"), "back-fills should not pin keys")
+	stored, err := master.Get("filled")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, stored)
+
+	assert.NoError(t, cr.delete(context.Background(), "other"))
+	assert.True(t, writes.pinned("other"), "deletes should pin keys")
+	assert.Equal(t, redis.Nil, cr.baseRedisClient.Get(context.Background(), "other").Err())
+}
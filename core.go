@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strings"
+	"sort"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -22,32 +22,77 @@ type Mnemosyne struct {
 type MnemosyneInstance struct {
 	name         string
 	cacheLayers  []*cache
-	cacheWatcher ICounter
+	observer     Observer
+	stats        *statsCollector
+	tracer       Tracer
 	softTTL      time.Duration
+	refresh      earlyRefresh
+	timeout      time.Duration
+	leaseTTL     time.Duration
+	warmOptions  *WarmOptions
+	stopWarm     context.CancelFunc
+	warmDone     chan struct{}
+	snapshotFile string
+	// removeSamplers stop observers from sampling the layers once closed
+	removeSamplers []func()
+}
+
+// Option configures optional behaviour of Mnemosyne
+type Option func(*options)
+
+type options struct {
+	observers []Observer
+	tracer    Tracer
+}
+
+// WithObserver registers an Observer which receives the events of all cache
+// instances, in addition to commTimer and cacheHitCounter. An observer which
+// is also passed as commTimer or cacheHitCounter only receives the events.
+func WithObserver(observer Observer) Option {
+	return func(o *options) {
+		o.observers = append(o.observers, observer)
+	}
 }
 
 // NewMnemosyne initializes the Mnemosyne object which holds all cache instances
-func NewMnemosyne(config *viper.Viper, commTimer ITimer, cacheHitCounter ICounter) *Mnemosyne {
+func NewMnemosyne(config *viper.Viper, commTimer ITimer, cacheHitCounter ICounter, opts ...Option) *Mnemosyne {
 	if config == nil {
-		logrus.Panicf("%w: nil config", ErrInvalidConfig)
+		logrus.Panicf("%v: nil config", ErrInvalidConfig)
 	}
 
-	if commTimer == nil {
-		commTimer = NewDummyTimer()
+	var o options
+	for _, opt := range opts {
+		opt(&o)
 	}
-	if cacheHitCounter == nil {
-		cacheHitCounter = NewDummyCounter()
+	observers := o.observers
+	for _, observer := range observers {
+		// an observer which is also the timer or counter already gets every
+		// event, with the instance the positional labels lack
+		if timer, ok := observer.(ITimer); ok && timer == commTimer {
+			commTimer = nil
+		}
+		if counter, ok := observer.(ICounter); ok && counter == cacheHitCounter {
+			cacheHitCounter = nil
+		}
+	}
+	if commTimer != nil || cacheHitCounter != nil || len(observers) == 0 {
+		observers = append([]Observer{NewLegacyObserver(commTimer, cacheHitCounter)}, observers...)
+	}
+	observer := combineObservers(observers...)
+	tracer := o.tracer
+	if tracer == nil {
+		tracer = noopTracer{}
 	}
 
 	cacheConfigs := config.GetStringMap("cache")
 	if len(cacheConfigs) == 0 {
-		logrus.Panicf("%w: no cache configurations found", ErrInvalidConfig)
+		logrus.Panicf("%v: no cache configurations found", ErrInvalidConfig)
 	}
 
 	caches := make(map[string]*MnemosyneInstance, len(cacheConfigs))
 
 	for cacheName := range cacheConfigs {
-		instance, err := newMnemosyneInstance(cacheName, config, commTimer, cacheHitCounter)
+		instance, err := newMnemosyneInstance(cacheName, config, observer, tracer)
 		if err != nil {
 			logrus.WithError(err).
 				WithField("cache", cacheName).
@@ -60,7 +105,15 @@ func NewMnemosyne(config *viper.Viper, commTimer ITimer, cacheHitCounter ICounte
 	}
 
 	if len(caches) == 0 {
-		logrus.Panicf("%w: no valid cache instances created", ErrInvalidConfig)
+		logrus.Panicf("%v: no valid cache instances created", ErrInvalidConfig)
+	}
+	for _, instance := range caches {
+		instance.startWarm()
+		for _, registered := range o.observers {
+			if sampled, ok := registered.(sampledObserver); ok {
+				instance.removeSamplers = append(instance.removeSamplers, sampled.addSampler(instance.sampleMemory))
+			}
+		}
 	}
 
 	return &Mnemosyne{
@@ -77,7 +130,28 @@ func (m *Mnemosyne) Select(cacheName string) *MnemosyneInstance {
 	return instance
 }
 
-func newMnemosyneInstance(name string, config *viper.Viper, commTimer ITimer, hitCounter ICounter) (*MnemosyneInstance, error) {
+// Instances returns the names of all cache instances in sorted order
+func (m *Mnemosyne) Instances() []string {
+	names := make([]string, 0, len(m.instances))
+	for name := range m.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes all cache instances
+func (m *Mnemosyne) Close() error {
+	var errs []error
+	for name, instance := range m.instances {
+		if err := instance.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func newMnemosyneInstance(name string, config *viper.Viper, observer Observer, tracer Tracer) (_ *MnemosyneInstance, err error) {
 	configKeyPrefix := fmt.Sprintf("cache.%s", name)
 	layerNames := config.GetStringSlice(configKeyPrefix + ".layers")
 
@@ -85,13 +159,23 @@ func newMnemosyneInstance(name string, config *viper.Viper, commTimer ITimer, hi
 		return nil, fmt.Errorf("%w: no layers configured for cache instance %q", ErrInvalidConfig, name)
 	}
 
+	stats := newStatsCollector(layerNames)
+	observer = combineObservers(observer, stats)
 	cacheLayers := make([]*cache, 0, len(layerNames))
+	defer func() {
+		// layers run background work and hold connections from the start
+		if err != nil {
+			for _, layer := range cacheLayers {
+				_ = layer.close()
+			}
+		}
+	}()
 
 	for _, layerName := range layerNames {
 		keyPrefix := fmt.Sprintf("%s.%s", configKeyPrefix, layerName)
 		layerType := config.GetString(keyPrefix + ".type")
 
-		layer, err := createCacheLayer(layerType, layerName, keyPrefix, config, commTimer)
+		layer, err := createCacheLayer(name, layerType, layerName, keyPrefix, config, observer, tracer)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create cache layer %q: %w", layerName, err)
 		}
@@ -103,48 +187,180 @@ func newMnemosyneInstance(name string, config *viper.Viper, commTimer ITimer, hi
 	if softTTL <= 0 {
 		return nil, fmt.Errorf("%w: invalid soft-ttl for cache instance %q", ErrInvalidConfig, name)
 	}
+	for _, layer := range cacheLayers {
+		layer.softTTL = softTTL
+	}
 
-	return &MnemosyneInstance{
+	beta := defaultRefreshBeta
+	if config.IsSet(configKeyPrefix + ".beta") {
+		beta = config.GetFloat64(configKeyPrefix + ".beta")
+	}
+	timeout, err := newInstanceTimeout(config, configKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	warmOptions, err := newWarmOptions(config, configKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if warmOptions != nil {
+		if _, err := warmSource(cacheLayers, warmOptions.From); err != nil {
+			return nil, err
+		}
+	}
+	leaseTTL := defaultLeaseTTL
+	if config.IsSet(configKeyPrefix + ".lease-ttl") {
+		if leaseTTL = config.GetDuration(configKeyPrefix + ".lease-ttl"); leaseTTL <= 0 {
+			return nil, fmt.Errorf("%w: lease-ttl must be positive, got %v", ErrInvalidConfig, leaseTTL)
+		}
+	}
+	refresh, err := newEarlyRefresh(config.GetBool(configKeyPrefix+".early-refresh"), beta)
+	if err != nil {
+		return nil, err
+	}
+
+	instance := &MnemosyneInstance{
 		name:         name,
 		cacheLayers:  cacheLayers,
-		cacheWatcher: hitCounter,
+		observer:     observer,
+		stats:        stats,
+		tracer:       tracer,
 		softTTL:      softTTL,
-	}, nil
+		refresh:      refresh,
+		timeout:      timeout,
+		leaseTTL:     leaseTTL,
+		warmOptions:  warmOptions,
+		warmDone:     make(chan struct{}),
+		snapshotFile: config.GetString(configKeyPrefix + ".snapshot-file"),
+	}
+	if instance.snapshotFile != "" {
+		instance.restoreFromFile(instance.snapshotFile)
+	}
+	return instance, nil
 }
 
-func createCacheLayer(layerType, layerName, keyPrefix string, config *viper.Viper, commTimer ITimer) (*cache, error) {
+func createCacheLayer(instanceName, layerType, layerName, keyPrefix string, config *viper.Viper, observer Observer, tracer Tracer) (*cache, error) {
+	amnesia, err := newAmnesiaMode(config.GetString(keyPrefix+".amnesia-mode"), config.GetDuration(keyPrefix+".amnesia-window"), config.GetDuration(keyPrefix+".ttl"))
+	if err != nil {
+		return nil, err
+	}
+	var layer *cache
 	switch layerType {
 	case "memory":
-		return newCacheInMem(layerName, config.GetInt(keyPrefix+".max-memory"), config.GetDuration(keyPrefix+".ttl"), config.GetInt(keyPrefix+".amnesia"), config.GetBool(keyPrefix+".compression")), nil
+		opts, err := newMemoryConfig(config, keyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		layer, err = newCacheInMem(layerName, opts, config.GetInt(keyPrefix+".amnesia"), config.GetBool(keyPrefix+".compression"), func(reason string) {
+			observer.Observe(Evict{Instance: instanceName, Layer: layerName, Reason: reason})
+		})
+		if err != nil {
+			return nil, err
+		}
 
 	case "redis":
-		return newCacheRedis(layerName, config.GetString(keyPrefix+".address"), config.GetInt(keyPrefix+".db"), config.GetDuration(keyPrefix+".ttl"), config.GetDuration(keyPrefix+".idle-timeout"), config.GetDuration(keyPrefix+".read-timeout"), config.GetDuration(keyPrefix+".write-timeout"), config.GetInt(keyPrefix+".amnesia"), config.GetBool(keyPrefix+".compression"), commTimer), nil
+		layer = newCacheRedis(layerName, config.GetString(keyPrefix+".address"), config.GetInt(keyPrefix+".db"), config.GetDuration(keyPrefix+".ttl"), config.GetDuration(keyPrefix+".idle-timeout"), config.GetDuration(keyPrefix+".read-timeout"), config.GetDuration(keyPrefix+".write-timeout"), config.GetInt(keyPrefix+".amnesia"), config.GetBool(keyPrefix+".compression"))
 
 	case "guardian", "gaurdian":
-		return newCacheClusterRedis(layerName, config.GetString(keyPrefix+".address"), config.GetStringSlice(keyPrefix+".slaves"), config.GetInt(keyPrefix+".db"), config.GetDuration(keyPrefix+".ttl"), config.GetDuration(keyPrefix+".idle-timeout"), config.GetDuration(keyPrefix+".read-timeout"), config.GetDuration(keyPrefix+".write-timeout"), config.GetInt(keyPrefix+".amnesia"), config.GetBool(keyPrefix+".compression"), commTimer), nil
+		layer = newCacheClusterRedis(layerName, config.GetString(keyPrefix+".address"), config.GetStringSlice(keyPrefix+".slaves"), config.GetInt(keyPrefix+".db"), config.GetDuration(keyPrefix+".ttl"), config.GetDuration(keyPrefix+".idle-timeout"), config.GetDuration(keyPrefix+".read-timeout"), config.GetDuration(keyPrefix+".write-timeout"), config.GetDuration(keyPrefix+".discovery-interval"), newRecentWrites(config.GetDuration(keyPrefix+".read-your-writes"), config.GetInt(keyPrefix+".wait-replicas"), config.GetDuration(keyPrefix+".wait-timeout")), config.GetInt(keyPrefix+".amnesia"), config.GetBool(keyPrefix+".compression"))
 
 	case "tiny":
-		return newCacheTiny(layerName, config.GetInt(keyPrefix+".amnesia"), config.GetBool(keyPrefix+".compression")), nil
+		store, err := newTinyStore(config.GetInt(keyPrefix+".max-entries"), config.GetInt64(keyPrefix+".max-bytes"), config.GetString(keyPrefix+".eviction"), func() {
+			observer.Observe(Evict{Instance: instanceName, Layer: layerName, Reason: "capacity"})
+		}, func(size int64) {
+			observer.Observe(Oversize{Instance: instanceName, Layer: layerName, Bytes: int(size), Limit: config.GetInt64(keyPrefix + ".max-bytes")})
+		})
+		if err != nil {
+			return nil, err
+		}
+		layer = newCacheTiny(layerName, store, config.GetDuration(keyPrefix+".ttl"), config.GetDuration(keyPrefix+".cleanup-interval"), config.GetInt(keyPrefix+".amnesia"), config.GetBool(keyPrefix+".compression"))
+
+	case "disk":
+		store, err := newDiskStore(config.GetString(keyPrefix+".directory"), config.GetInt64(keyPrefix+".max-bytes"), func(reason string) {
+			observer.Observe(Evict{Instance: instanceName, Layer: layerName, Reason: reason})
+		})
+		if err != nil {
+			return nil, err
+		}
+		layer = newCacheDisk(layerName, store, config.GetDuration(keyPrefix+".ttl"), config.GetDuration(keyPrefix+".cleanup-interval"), config.GetInt(keyPrefix+".amnesia"), config.GetBool(keyPrefix+".compression"))
 
 	default:
 		return nil, fmt.Errorf("unknown cache type %q", layerType)
 	}
+
+	// layers talking to Redis get a breaker and retries, those which may
+	// read from slaves can also hedge
+	if layer.baseRedisClient != nil {
+		if layer.breaker, err = newCircuitBreaker(config, keyPrefix, layer.breakerChanged); err != nil {
+			_ = layer.close()
+			return nil, err
+		}
+		if layer.retry, err = newRetryPolicy(config, keyPrefix); err != nil {
+			_ = layer.close()
+			return nil, err
+		}
+	}
+	if layer.slaveRedisClients != nil {
+		if layer.hedge, err = newHedgePolicy(config, keyPrefix); err != nil {
+			_ = layer.close()
+			return nil, err
+		}
+	}
+	if layer.sizeLimit, err = newSizeLimit(config, keyPrefix); err != nil {
+		_ = layer.close()
+		return nil, err
+	}
+	if layer.legacyFormat, err = newStorageFormat(config, keyPrefix); err != nil {
+		_ = layer.close()
+		return nil, err
+	}
+	if layer.opTimeout = config.GetDuration(keyPrefix + ".op-timeout"); layer.opTimeout < 0 {
+		_ = layer.close()
+		return nil, fmt.Errorf("%w: op-timeout must not be negative, got %v", ErrInvalidConfig, layer.opTimeout)
+	}
+	layer.amnesia = amnesia
+	layer.corruptLog = &logSampler{}
+	layer.instanceName = instanceName
+	layer.observer = observer
+	layer.tracer = tracer
+	return layer, nil
 }
 
 func (mn *MnemosyneInstance) get(ctx context.Context, key string) (*cachableRet, error) {
+	ctx, span := mn.startSpan(ctx, "mnemosyne.Get", key)
+	defer span.End()
+	ctx, cancel := mn.withBudget(ctx)
+	defer cancel()
+
 	for i, layer := range mn.cacheLayers {
-		result, err := layer.withContext(ctx).get(key)
+		layerCtx, cancelLayer, ok := mn.layerContext(ctx, i)
+		if !ok {
+			break
+		}
+		result, err := layer.withContext(layerCtx).get(key)
+		cancelLayer()
 		if err == nil {
-			mn.cacheWatcher.Inc(mn.name, fmt.Sprintf("layer%d", i))
+			span.SetAttributes(Attribute{Key: AttrHit, Value: true}, Attribute{Key: AttrLayer, Value: layer.layerName})
+			mn.observer.Observe(Hit{Instance: mn.name, Layer: layer.layerName, Index: i, Age: time.Since(result.Time)})
 			go mn.fillUpperLayers(ctx, key, result, i)
 			return result, nil
 		}
 	}
 
-	mn.cacheWatcher.Inc(mn.name, "miss")
+	span.SetAttributes(Attribute{Key: AttrHit, Value: false})
+	mn.observer.Observe(Miss{Instance: mn.name})
 	return nil, ErrNotFound
 }
 
+func (mn *MnemosyneInstance) startSpan(ctx context.Context, name, key string) (context.Context, Span) {
+	ctx, span := mn.tracer.Start(ctx, name)
+	span.SetAttributes(
+		Attribute{Key: AttrInstance, Value: mn.name},
+		Attribute{Key: AttrKeyHash, Value: keyHash(key)},
+	)
+	return ctx, span
+}
+
 // Get retrieves the value for key
 func (mn *MnemosyneInstance) Get(ctx context.Context, key string, ref interface{}) error {
 	cachableObj, err := mn.get(ctx, key)
@@ -179,7 +395,7 @@ func (mn *MnemosyneInstance) GetAndShouldUpdate(ctx context.Context, key string,
 	dataAge := time.Since(cachableObj.Time)
 	go mn.monitorDataHotness(dataAge)
 
-	return dataAge > mn.softTTL, nil
+	return mn.shouldUpdate(cachableObj), nil
 }
 
 // ShouldUpdate indicates if the soft-TTL of a key has expired
@@ -195,31 +411,44 @@ func (mn *MnemosyneInstance) ShouldUpdate(ctx context.Context, key string) (bool
 		return false, ErrNilCache
 	}
 
-	return time.Since(cachableObj.Time) > mn.softTTL, nil
+	return mn.shouldUpdate(cachableObj), nil
 }
 
 // Set sets the value for a key in all layers of the cache instance
 func (mn *MnemosyneInstance) Set(ctx context.Context, key string, value interface{}) error {
+	return mn.set(ctx, key, value, 0)
+}
+
+func (mn *MnemosyneInstance) set(ctx context.Context, key string, value interface{}, cost time.Duration) error {
 	if value == nil {
 		return ErrNilValue
 	}
 
+	ctx, span := mn.startSpan(ctx, "mnemosyne.Set", key)
+	defer span.End()
+
 	toCache := cachable{
 		CachedObject: value,
 		Time:         time.Now(),
+		Delta:        cost,
 	}
 
-	var errs []string
-	for _, layer := range mn.cacheLayers {
-		if err := layer.withContext(ctx).set(key, toCache); err != nil {
-			errs = append(errs, fmt.Sprintf("%s: %v", layer.layerName, err))
-		}
-	}
+	ctx, cancel := mn.withBudget(ctx)
+	defer cancel()
 
-	if len(errs) > 0 {
-		return fmt.Errorf("cache set errors: %s", strings.Join(errs, "; "))
+	var errs []error
+	for i, layer := range mn.cacheLayers {
+		layerCtx, cancelLayer, ok := mn.layerContext(ctx, i)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %w", layer.layerName, context.DeadlineExceeded))
+			continue
+		}
+		if err := layer.withContext(layerCtx).set(key, toCache); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", layer.layerName, err))
+		}
+		cancelLayer()
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 // TTL returns the TTL of the first accessible data instance and its layer index
@@ -234,17 +463,61 @@ func (mn *MnemosyneInstance) TTL(key string) (int, time.Duration) {
 
 // Delete removes a key from all layers
 func (mn *MnemosyneInstance) Delete(ctx context.Context, key string) error {
-	var errs []string
+	ctx, span := mn.startSpan(ctx, "mnemosyne.Delete", key)
+	defer span.End()
+
+	ctx, cancel := mn.withBudget(ctx)
+	defer cancel()
+
+	var errs []error
+	for i, layer := range mn.cacheLayers {
+		layerCtx, cancelLayer, ok := mn.layerContext(ctx, i)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %w", layer.layerName, context.DeadlineExceeded))
+			continue
+		}
+		err := layer.delete(layerCtx, key)
+		cancelLayer()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			errs = append(errs, fmt.Errorf("%s: %w", layer.layerName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops background work of all layers and releases their connections
+func (mn *MnemosyneInstance) Close() error {
+	if mn.stopWarm != nil {
+		// the warm-up must not write into closed layers or the snapshot
+		mn.stopWarm()
+		<-mn.warmDone
+	}
+	for _, remove := range mn.removeSamplers {
+		remove()
+	}
+	var errs []error
+	if mn.snapshotFile != "" {
+		if err := mn.snapshotToFile(mn.snapshotFile); err != nil {
+			errs = append(errs, fmt.Errorf("snapshot: %w", err))
+		}
+	}
 	for _, layer := range mn.cacheLayers {
-		if err := layer.delete(ctx, key); err != nil && !errors.Is(err, redis.Nil) {
-			errs = append(errs, fmt.Sprintf("%s: %v", layer.layerName, err))
+		if err := layer.close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", layer.layerName, err))
 		}
 	}
+	return errors.Join(errs...)
+}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("cache delete errors: %s", strings.Join(errs, "; "))
+// MemoryStats returns the statistics of the memory layers of the instance by layer name
+func (mn *MnemosyneInstance) MemoryStats() map[string]MemoryStats {
+	stats := make(map[string]MemoryStats)
+	for _, layer := range mn.cacheLayers {
+		if layer.inMemCache != nil {
+			stats[layer.layerName] = layer.memoryStats()
+		}
 	}
-	return nil
+	return stats
 }
 
 // Flush completely clears a single layer of the cache
@@ -263,7 +536,12 @@ func (mn *MnemosyneInstance) fillUpperLayers(_ context.Context, key string, valu
 	}
 
 	for i := layer - 1; i >= 0; i-- {
-		if err := mn.cacheLayers[i].set(key, *value); err != nil {
+		err := mn.cacheLayers[i].fill(key, *value)
+		if errors.Is(err, errTooLargeToFill) {
+			continue
+		}
+		mn.observer.Observe(Fill{Instance: mn.name, Layer: mn.cacheLayers[i].layerName, From: mn.cacheLayers[layer].layerName, Err: err})
+		if err != nil {
 			logrus.WithError(err).
 				WithField("layer", i).
 				WithField("key", key).
@@ -273,12 +551,12 @@ func (mn *MnemosyneInstance) fillUpperLayers(_ context.Context, key string, valu
 }
 
 func (mn *MnemosyneInstance) monitorDataHotness(age time.Duration) {
+	level := "cold"
 	switch {
 	case age <= mn.softTTL:
-		mn.cacheWatcher.Inc(mn.name+"-hotness", "hot")
+		level = "hot"
 	case age <= mn.softTTL*2:
-		mn.cacheWatcher.Inc(mn.name+"-hotness", "warm")
-	default:
-		mn.cacheWatcher.Inc(mn.name+"-hotness", "cold")
+		level = "warm"
 	}
+	mn.observer.Observe(Hotness{Instance: mn.name, Level: level, Age: age})
 }
@@ -0,0 +1,31 @@
+package mnemosyne
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokenInstanceClosesItsLayers(t *testing.T) {
+	config := viper.New()
+	config.Set("cache.broken.layers", []string{"tiny-layer", "disk-layer"})
+	config.Set("cache.broken.tiny-layer.type", "tiny")
+	config.Set("cache.broken.disk-layer.type", "disk")
+	config.Set("cache.broken.disk-layer.directory", t.TempDir())
+	// the layers are valid, the missing soft-ttl fails the instance
+
+	baseline := runtime.NumGoroutine()
+	for range 10 {
+		_, err := newMnemosyneInstance("broken", config, nil, noopTracer{})
+		assert.ErrorIs(t, err, ErrInvalidConfig)
+	}
+	// assert.Eventually runs its condition in a goroutine of its own
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), baseline, "the janitors of the layers were left running")
+}
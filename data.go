@@ -8,9 +8,13 @@ import (
 type cachable struct {
 	Time         time.Time
 	CachedObject interface{}
+	// Delta is the time it took to compute CachedObject, used for early
+	// refresh. It is stored in the envelope header rather than the JSON.
+	Delta time.Duration `json:"-"`
 }
 
 type cachableRet struct {
 	Time         time.Time
 	CachedObject *json.RawMessage
+	Delta        time.Duration `json:"-"`
 }
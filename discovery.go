@@ -0,0 +1,237 @@
+package mnemosyne
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// replicaRetireGrace is how long the client of a replica which disappeared is
+// kept open, so reads which picked it from the previous slave set can finish
+const replicaRetireGrace = 30 * time.Second
+
+// replicaDiscovery periodically asks a guardian master for its replicas and
+// keeps the layer's slave clients in sync with the reported topology.
+//
+// Replicas are read from INFO replication rather than ROLE: both list the
+// same addresses, but only INFO reports the link state, and a replica which
+// is still loading its initial sync must not be read from. Either way the
+// master reports the IP a replica connected from, so configured slaves whose
+// address is a hostname are matched by resolving it.
+type replicaDiscovery struct {
+	layerName  string
+	master     *redis.Client
+	slaves     *atomic.Pointer[[]*redis.Client]
+	newClient  func(addr string) *redis.Client
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	interval   time.Duration
+
+	known    map[string]*redis.Client
+	retired  *retiredClients
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newReplicaDiscovery(layerName string, master *redis.Client, slaves *atomic.Pointer[[]*redis.Client], seed map[string]*redis.Client, interval, grace time.Duration, newClient func(addr string) *redis.Client) *replicaDiscovery {
+	return &replicaDiscovery{
+		layerName:  layerName,
+		master:     master,
+		slaves:     slaves,
+		newClient:  newClient,
+		lookupHost: net.DefaultResolver.LookupHost,
+		interval:   interval,
+		known:      seed,
+		retired:    newRetiredClients(grace),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (rd *replicaDiscovery) run() {
+	defer close(rd.done)
+	rd.refresh()
+
+	ticker := time.NewTicker(rd.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rd.stop:
+			return
+		case <-ticker.C:
+			rd.refresh()
+		}
+	}
+}
+
+// refresh queries the master once and swaps in the discovered replica set.
+// Clients of replicas which are no longer reported are closed after a grace
+// period.
+func (rd *replicaDiscovery) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), rd.interval)
+	defer cancel()
+
+	info, err := rd.master.Info(ctx, "replication").Result()
+	if err != nil {
+		logrus.WithError(err).
+			WithField("layer", rd.layerName).
+			Warn("failed to discover replicas, keeping the current set")
+		return
+	}
+
+	addrs := parseReplicas(info)
+	current := make(map[string]*redis.Client, len(addrs))
+	clients := make([]*redis.Client, 0, len(addrs))
+	for _, addr := range addrs {
+		client, ok := rd.known[addr]
+		if !ok {
+			client, ok = rd.adopt(ctx, addr)
+		}
+		if !ok {
+			client = rd.newClient(addr)
+			logrus.WithField("layer", rd.layerName).
+				WithField("replica", addr).
+				Info("discovered new replica")
+		}
+		current[addr] = client
+		clients = append(clients, client)
+	}
+	rd.slaves.Store(&clients)
+
+	for addr, client := range rd.known {
+		if _, ok := current[addr]; ok {
+			continue
+		}
+		logrus.WithField("layer", rd.layerName).
+			WithField("replica", addr).
+			Info("replica disappeared, closing its client")
+		rd.retired.retire(addr, client)
+	}
+	rd.known = current
+}
+
+// adopt looks for a known client configured by a hostname which resolves to
+// the reported addr. The client is taken out of known, so that refresh keys
+// it by addr from then on.
+func (rd *replicaDiscovery) adopt(ctx context.Context, addr string) (*redis.Client, bool) {
+	ip, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	reported := net.ParseIP(ip)
+	for knownAddr, client := range rd.known {
+		host, knownPort, err := net.SplitHostPort(knownAddr)
+		if err != nil || knownPort != port || net.ParseIP(host) != nil {
+			continue
+		}
+		resolved, err := rd.lookupHost(ctx, host)
+		if err != nil {
+			logrus.WithError(err).
+				WithField("layer", rd.layerName).
+				WithField("replica", knownAddr).
+				Warn("failed to resolve replica address")
+			continue
+		}
+		for _, r := range resolved {
+			if reported.Equal(net.ParseIP(r)) {
+				delete(rd.known, knownAddr)
+				return client, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// close stops the discovery loop, waits for it to exit and closes the
+// clients still in their grace period
+func (rd *replicaDiscovery) close() {
+	rd.stopOnce.Do(func() {
+		close(rd.stop)
+	})
+	<-rd.done
+	rd.retired.closeAll()
+}
+
+// retiredClients closes clients once their grace period has passed
+type retiredClients struct {
+	grace time.Duration
+
+	mu      sync.Mutex
+	pending map[*redis.Client]*time.Timer
+}
+
+func newRetiredClients(grace time.Duration) *retiredClients {
+	return &retiredClients{grace: grace, pending: make(map[*redis.Client]*time.Timer)}
+}
+
+func (rc *retiredClients) retire(addr string, client *redis.Client) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.pending[client] = time.AfterFunc(rc.grace, func() {
+		rc.mu.Lock()
+		_, ok := rc.pending[client]
+		delete(rc.pending, client)
+		rc.mu.Unlock()
+		if ok {
+			closeReplicaClient(addr, client)
+		}
+	})
+}
+
+// closeAll closes every pending client right away
+func (rc *retiredClients) closeAll() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for client, timer := range rc.pending {
+		timer.Stop()
+		closeReplicaClient(client.Options().Addr, client)
+	}
+	clear(rc.pending)
+}
+
+func closeReplicaClient(addr string, client *redis.Client) {
+	if err := client.Close(); err != nil {
+		logrus.WithError(err).
+			WithField("replica", addr).
+			Warn("failed to close replica client")
+	}
+}
+
+// parseReplicas extracts the addresses of online replicas from the output of
+// INFO replication, e.g. "slave0:ip=10.0.0.2,port=6379,state=online,offset=1,lag=0"
+func parseReplicas(info string) []string {
+	var addrs []string
+	for _, line := range strings.Split(info, "\n") {
+		name, fields, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok || !strings.HasPrefix(name, "slave") || len(name) == len("slave") {
+			continue
+		}
+		if c := name[len("slave")]; c < '0' || c > '9' {
+			continue
+		}
+
+		var ip, port, state string
+		for _, field := range strings.Split(fields, ",") {
+			k, v, _ := strings.Cut(field, "=")
+			switch k {
+			case "ip":
+				ip = v
+			case "port":
+				port = v
+			case "state":
+				state = v
+			}
+		}
+		if ip == "" || port == "" || state != "online" {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs
+}
@@ -0,0 +1,226 @@
+package mnemosyne
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReplicas(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		want []string
+	}{
+		{
+			name: "online replicas",
+			info: "# Replication\r\nrole:master\r\nconnected_slaves:2\r\n" +
+				"slave0:ip=10.0.0.2,port=6379,state=online,offset=10,lag=0\r\n" +
+				"slave1:ip=10.0.0.3,port=6380,state=online,offset=10,lag=1\r\n" +
+				"master_repl_offset:10\r\n",
+			want: []string{"10.0.0.2:6379", "10.0.0.3:6380"},
+		},
+		{
+			name: "replicas which are not online are skipped",
+			info: "slave0:ip=10.0.0.2,port=6379,state=wait_bgsave,offset=0,lag=0\r\n" +
+				"slave1:ip=10.0.0.3,port=6379,state=online,offset=10,lag=0\r\n",
+			want: []string{"10.0.0.3:6379"},
+		},
+		{
+			name: "ipv6 addresses are bracketed",
+			info: "slave0:ip=::1,port=6379,state=online,offset=10,lag=0\n",
+			want: []string{"[::1]:6379"},
+		},
+		{
+			name: "fields which only start with slave are ignored",
+			info: "slave_read_only:1\r\nslave_repl_offset:10\r\nslaves:ip=10.0.0.2,port=6379,state=online\r\n",
+		},
+		{
+			name: "incomplete lines are ignored",
+			info: "slave0:ip=10.0.0.2,state=online\r\nslave1:port=6379,state=online\r\nslave2\r\n",
+		},
+		{
+			name: "replica without replicas",
+			info: "# Replication\r\nrole:slave\r\nmaster_host:10.0.0.1\r\nconnected_slaves:0\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseReplicas(tt.info))
+		})
+	}
+}
+
+func TestRetiredClients(t *testing.T) {
+	server := miniredis.RunT(t)
+	ctx := context.Background()
+	retired := newRetiredClients(50 * time.Millisecond)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	retired.retire(server.Addr(), client)
+	assert.NoError(t, client.Ping(ctx).Err(), "retired clients should serve reads during the grace period")
+	assert.Eventually(t, func() bool {
+		return client.Ping(ctx).Err() == redis.ErrClosed
+	}, time.Second, 10*time.Millisecond)
+
+	pending := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	retired.retire(server.Addr(), pending)
+	retired.closeAll()
+	assert.ErrorIs(t, pending.Ping(ctx).Err(), redis.ErrClosed, "closeAll should not wait for the grace period")
+}
+
+func TestReplicaDiscovery(t *testing.T) {
+	master := newFakeMaster(t)
+	masterClient := redis.NewClient(&redis.Options{Addr: master.ln.Addr().String()})
+	t.Cleanup(func() { masterClient.Close() })
+	ctx := context.Background()
+
+	first, second := miniredis.RunT(t), miniredis.RunT(t)
+	_, firstPort, _ := net.SplitHostPort(first.Addr())
+	seedAddr := net.JoinHostPort("replica.test", firstPort)
+	seedClient := redis.NewClient(&redis.Options{Addr: first.Addr()})
+	var slaves atomic.Pointer[[]*redis.Client]
+	slaves.Store(&[]*redis.Client{seedClient})
+
+	created := make(map[string]*redis.Client)
+	rd := newReplicaDiscovery("guardian", masterClient, &slaves, map[string]*redis.Client{seedAddr: seedClient},
+		time.Second, 50*time.Millisecond, func(addr string) *redis.Client {
+			client := redis.NewClient(&redis.Options{Addr: addr})
+			created[addr] = client
+			return client
+		})
+	rd.lookupHost = func(_ context.Context, host string) ([]string, error) {
+		if host == "replica.test" {
+			return []string{"127.0.0.1"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	t.Cleanup(rd.retired.closeAll)
+
+	master.setReplicas(first.Addr(), second.Addr())
+	rd.refresh()
+	require.Len(t, created, 1, "only the replica which was not configured should get a new client")
+	added := created[second.Addr()]
+	require.NotNil(t, added)
+	assert.Equal(t, []*redis.Client{seedClient, added}, *slaves.Load(),
+		"the configured slave should be kept although the master reports its ip")
+
+	master.setReplicas(second.Addr())
+	rd.refresh()
+	assert.Len(t, created, 1)
+	assert.Equal(t, []*redis.Client{added}, *slaves.Load())
+	assert.NoError(t, seedClient.Ping(ctx).Err(), "removed replicas should serve reads during the grace period")
+	assert.Eventually(t, func() bool {
+		return seedClient.Ping(ctx).Err() == redis.ErrClosed
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, added.Ping(ctx).Err())
+}
+
+// fakeMaster answers INFO with a configurable list of online replicas and
+// every other command with OK
+type fakeMaster struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	info string
+}
+
+func newFakeMaster(t *testing.T) *fakeMaster {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	fm := &fakeMaster{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fm.serve(conn)
+		}
+	}()
+	return fm
+}
+
+func (fm *fakeMaster) setReplicas(addrs ...string) {
+	info := "# Replication\r\nrole:master\r\n"
+	for i, addr := range addrs {
+		ip, port, _ := net.SplitHostPort(addr)
+		info += fmt.Sprintf("slave%d:ip=%s,port=%s,state=online,offset=1,lag=0\r\n", i, ip, port)
+	}
+	fm.mu.Lock()
+	fm.info = info
+	fm.mu.Unlock()
+}
+
+func (fm *fakeMaster) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		reply := "+OK\r\n"
+		switch strings.ToUpper(args[0]) {
+		case "HELLO":
+			reply = "-ERR unknown command 'HELLO'\r\n"
+		case "INFO":
+			fm.mu.Lock()
+			reply = fmt.Sprintf("$%d\r\n%s\r\n", len(fm.info), fm.info)
+			fm.mu.Unlock()
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads one command sent as a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readLength(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLength(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return args, nil
+}
+
+func readLength(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != prefix {
+		return 0, fmt.Errorf("unexpected line %q", line)
+	}
+	return strconv.Atoi(strings.TrimSpace(line[1:]))
+}
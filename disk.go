@@ -0,0 +1,449 @@
+package mnemosyne
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	diskTempPrefix = ".tmp-"
+	// diskTempMaxAge is the age after which compaction deletes temporary
+	// files left behind by writes which crashed
+	diskTempMaxAge = time.Minute
+	// diskLockStripes is the number of locks serialising the replacement
+	// and removal of entry files
+	diskLockStripes = 64
+)
+
+var errDiskMiss = errors.New("Failed to load from disk store")
+
+// diskStore keeps the entries of a disk layer as one file per key under dir,
+// named after the SHA-256 of the key. A file holds the encoded memEntry whose
+// value is the uvarint length-prefixed key followed by the stored bytes.
+// Files are written to a temporary file first and renamed into place, so
+// readers and crashes never see a partial entry.
+type diskStore struct {
+	dir      string
+	maxBytes int64
+	onEvict  func(reason string)
+
+	bytes      atomic.Int64
+	compacting atomic.Bool
+	// changes counts the updates of bytes, a compaction only replaces the
+	// count with its recount if none happened while it walked the store.
+	// countMu is held for reading by updates and for writing by the
+	// replacement, so no update slips in between the check and the store.
+	changes atomic.Uint64
+	countMu sync.RWMutex
+	// locks keep an entry written meanwhile from being removed in place of
+	// the one which was checked, striped by file name
+	locks [diskLockStripes]sync.Mutex
+
+	// mu guards closed, compactions are only started while the store is open
+	mu          sync.Mutex
+	closed      bool
+	compactions sync.WaitGroup
+}
+
+func newDiskStore(dir string, maxBytes int64, onEvict func(reason string)) (*diskStore, error) {
+	switch {
+	case dir == "":
+		return nil, fmt.Errorf("%w: disk layers need a directory", ErrInvalidConfig)
+	case maxBytes < 0:
+		return nil, fmt.Errorf("%w: max-bytes must not be negative, got %d", ErrInvalidConfig, maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	ds := &diskStore{dir: dir, maxBytes: maxBytes, onEvict: onEvict}
+	// count what an earlier process left behind without delaying startup
+	ds.compactInBackground()
+	return ds, nil
+}
+
+func newCacheDisk(layerName string, store *diskStore, TTL time.Duration, cleanupInterval time.Duration, amnesiaChance int, compressionEnabled bool) *cache {
+	if cleanupInterval <= 0 {
+		cleanupInterval = time.Minute
+	}
+	return &cache{
+		layerName:          layerName,
+		disk:               store,
+		janitor:            startJanitor(cleanupInterval, store.compact),
+		amnesiaChance:      amnesiaChance,
+		compressionEnabled: compressionEnabled,
+		cacheTTL:           TTL,
+		ctx:                context.TODO(),
+	}
+}
+
+func (ds *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(ds.dir, name[:2], name)
+}
+
+func encodeDiskEntry(key string, entry memEntry) []byte {
+	value := binary.AppendUvarint(nil, uint64(len(key)))
+	value = append(value, key...)
+	value = append(value, entry.value...)
+	return memEntry{value: value, storedAt: entry.storedAt, expiresAt: entry.expiresAt}.encode()
+}
+
+func decodeDiskEntry(buf []byte) (string, memEntry, error) {
+	entry, err := decodeMemEntry(buf)
+	if err != nil {
+		return "", entry, err
+	}
+	keyLen, n := binary.Uvarint(entry.value)
+	if n <= 0 || uint64(len(entry.value)-n) < keyLen {
+		return "", entry, errors.New("truncated disk entry")
+	}
+	key := string(entry.value[n : n+int(keyLen)])
+	entry.value = entry.value[n+int(keyLen):]
+	return key, entry, nil
+}
+
+// account adds delta to the stored bytes and returns the new count
+func (ds *diskStore) account(delta int64) int64 {
+	ds.countMu.RLock()
+	defer ds.countMu.RUnlock()
+	ds.changes.Add(1)
+	return ds.bytes.Add(delta)
+}
+
+// lock returns the lock of the entry file at path
+func (ds *diskStore) lock(path string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(filepath.Base(path)))
+	return &ds.locks[h.Sum32()%diskLockStripes]
+}
+
+// load reads key, lazily removing it if it has already expired
+func (ds *diskStore) load(key string) (memEntry, error) {
+	path := ds.path(key)
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return memEntry{}, errDiskMiss
+	} else if err != nil {
+		return memEntry{}, err
+	}
+	stored, entry, err := decodeDiskEntry(buf)
+	if err != nil {
+		return memEntry{}, err
+	}
+	if stored != key {
+		return memEntry{}, errDiskMiss
+	}
+	if entry.expired(time.Now()) {
+		ds.removeUnchanged(path, entry.storedAt)
+		return memEntry{}, errExpired
+	}
+	return entry, nil
+}
+
+func (ds *diskStore) store(key string, entry memEntry) error {
+	path := ds.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), diskTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	buf := encodeDiskEntry(key, entry)
+	if _, err := tmp.Write(buf); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	mu := ds.lock(path)
+	mu.Lock()
+	var previous int64
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		mu.Unlock()
+		return err
+	}
+	total := ds.account(int64(len(buf)) - previous)
+	mu.Unlock()
+
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if total > ds.maxBytes && ds.maxBytes > 0 {
+		ds.compactInBackground()
+	}
+	return nil
+}
+
+// removeUnchanged removes the entry file at path if it still holds the entry
+// stored at storedAt, and returns the size it freed
+func (ds *diskStore) removeUnchanged(path string, storedAt time.Time) (int64, bool) {
+	mu := ds.lock(path)
+	mu.Lock()
+	defer mu.Unlock()
+	entry, err := readDiskHeader(path)
+	if err != nil || !entry.storedAt.Equal(storedAt) {
+		return 0, false
+	}
+	info, err := os.Stat(path)
+	if err != nil || os.Remove(path) != nil {
+		return 0, false
+	}
+	ds.account(-info.Size())
+	return info.Size(), true
+}
+
+func (ds *diskStore) remove(key string) error {
+	path := ds.path(key)
+	mu := ds.lock(path)
+	mu.Lock()
+	defer mu.Unlock()
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	ds.account(-info.Size())
+	return nil
+}
+
+func (ds *diskStore) clear() error {
+	dirs, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, d := range dirs {
+		errs = append(errs, os.RemoveAll(filepath.Join(ds.dir, d.Name())))
+	}
+	ds.countMu.RLock()
+	ds.changes.Add(1)
+	ds.bytes.Store(0)
+	ds.countMu.RUnlock()
+	return errors.Join(errs...)
+}
+
+func (ds *diskStore) size() int64 {
+	return max(ds.bytes.Load(), 0)
+}
+
+// each calls fn for the keys of the store until it returns false. Only the
+// head of each file is read, so the entries carry their times but no value.
+// Entries which cannot be read are skipped.
+func (ds *diskStore) each(fn func(key string, entry memEntry) bool) {
+	_ = filepath.WalkDir(ds.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), diskTempPrefix) {
+			return nil
+		}
+		key, entry, err := readDiskKey(path)
+		if err != nil {
+			return nil
+		}
+		if !fn(key, entry) {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+}
+
+type diskFile struct {
+	path     string
+	size     int64
+	storedAt time.Time
+}
+
+// compactInBackground starts a compaction which close waits for, unless one
+// is already running or the store is closed
+func (ds *diskStore) compactInBackground() {
+	if ds.compacting.Load() {
+		return
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.closed {
+		return
+	}
+	ds.compactions.Add(1)
+	go func() {
+		defer ds.compactions.Done()
+		ds.compact()
+	}()
+}
+
+// close waits for background compactions to finish
+func (ds *diskStore) close() {
+	ds.mu.Lock()
+	ds.closed = true
+	ds.mu.Unlock()
+	ds.compactions.Wait()
+}
+
+// compact deletes expired entries and stale temporary files, recounts the
+// stored bytes and evicts the oldest entries while the store exceeds
+// max-bytes. Only one compaction runs at a time.
+func (ds *diskStore) compact() {
+	if !ds.compacting.CompareAndSwap(false, true) {
+		return
+	}
+	var raced bool
+	defer func() {
+		ds.compacting.Store(false)
+		// writes which raced with the compaction may have exceeded
+		// max-bytes again after it evicted
+		if raced && ds.maxBytes > 0 && ds.size() > ds.maxBytes {
+			ds.compactInBackground()
+		}
+	}()
+
+	// removals update the count as they happen, the recount replaces it
+	// only if nothing but the removals of this compaction changed it
+	changes := ds.changes.Load()
+	changed := make(map[string]bool)
+	remove := func(path string, storedAt time.Time, reason string) bool {
+		_, ok := ds.removeUnchanged(path, storedAt)
+		if ok {
+			changes++
+			changed[filepath.Dir(path)] = true
+			ds.evicted(reason)
+		}
+		return ok
+	}
+
+	now := time.Now()
+	var live []diskFile
+	var total int64
+	_ = filepath.WalkDir(ds.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), diskTempPrefix) {
+			if now.Sub(info.ModTime()) > diskTempMaxAge {
+				_ = os.Remove(path)
+			}
+			return nil
+		}
+		entry, err := readDiskHeader(path)
+		if err != nil {
+			return nil
+		}
+		if entry.expired(now) && remove(path, entry.storedAt, "expired") {
+			return nil
+		}
+		live = append(live, diskFile{path: path, size: info.Size(), storedAt: entry.storedAt})
+		total += info.Size()
+		return nil
+	})
+
+	if ds.maxBytes > 0 && total > ds.maxBytes {
+		slices.SortFunc(live, func(a, b diskFile) int {
+			return a.storedAt.Compare(b.storedAt)
+		})
+		for _, file := range live {
+			if total <= ds.maxBytes {
+				break
+			}
+			if remove(file.path, file.storedAt, "capacity") {
+				total -= file.size
+			}
+		}
+	}
+	ds.countMu.Lock()
+	raced = ds.changes.Load() != changes
+	if !raced {
+		ds.bytes.Store(total)
+	}
+	ds.countMu.Unlock()
+	for dir := range changed {
+		_ = syncDir(dir)
+	}
+}
+
+// readDiskHeader reads only the times of the entry stored at path
+func readDiskHeader(path string) (memEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return memEntry{}, err
+	}
+	defer f.Close()
+	header := make([]byte, memEntryHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return memEntry{}, err
+	}
+	return decodeMemEntry(header)
+}
+
+// readDiskKey reads the times and the key of the entry stored at path,
+// without its value
+func readDiskKey(path string) (string, memEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", memEntry{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", memEntry{}, err
+	}
+	r := bufio.NewReader(f)
+	header := make([]byte, memEntryHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", memEntry{}, err
+	}
+	entry, err := decodeMemEntry(header)
+	if err != nil {
+		return "", memEntry{}, err
+	}
+	keyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", memEntry{}, err
+	}
+	if keyLen > uint64(info.Size()) {
+		return "", memEntry{}, errors.New("truncated disk entry")
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", memEntry{}, err
+	}
+	entry.value = nil
+	return string(key), entry, nil
+}
+
+func (ds *diskStore) evicted(reason string) {
+	if ds.onEvict != nil {
+		ds.onEvict(reason)
+	}
+}
@@ -0,0 +1,74 @@
+package mnemosyne
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskStoreStartupCompaction(t *testing.T) {
+	dir := t.TempDir()
+	first, err := newDiskStore(dir, 0, nil)
+	assert.NoError(t, err)
+	// keep the startup compaction of the first store out of the way
+	first.close()
+	expired := newMemEntry([]byte("old"), time.Hour)
+	expired.expiresAt = time.Now().Add(-time.Minute)
+	assert.NoError(t, first.store("expired", expired))
+	assert.NoError(t, first.store("live", newMemEntry([]byte("new"), time.Hour)))
+
+	evictions := 0
+	second, err := newDiskStore(dir, 0, func(reason string) { evictions++ })
+	assert.NoError(t, err)
+	// close waits for the compaction started by newDiskStore
+	second.close()
+	assert.Equal(t, 1, evictions)
+	assert.NoFileExists(t, second.path("expired"))
+	assert.FileExists(t, second.path("live"))
+	info, err := os.Stat(second.path("live"))
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), second.size())
+}
+
+func TestDiskStoreEachSkipsValues(t *testing.T) {
+	ds, err := newDiskStore(t.TempDir(), 0, nil)
+	assert.NoError(t, err)
+	t.Cleanup(ds.close)
+	stored := newMemEntry(bytes.Repeat([]byte("x"), 1<<20), time.Hour)
+	assert.NoError(t, ds.store("large", stored))
+
+	var keys []string
+	ds.each(func(key string, entry memEntry) bool {
+		keys = append(keys, key)
+		assert.Nil(t, entry.value)
+		assert.True(t, entry.storedAt.Equal(stored.storedAt))
+		assert.True(t, entry.expiresAt.Equal(stored.expiresAt))
+		return true
+	})
+	assert.Equal(t, []string{"large"}, keys)
+}
+
+func TestDiskStoreKeepsReplacedEntries(t *testing.T) {
+	ds, err := newDiskStore(t.TempDir(), 0, nil)
+	assert.NoError(t, err)
+	t.Cleanup(ds.close)
+	expired := newMemEntry([]byte("old"), time.Hour)
+	expired.expiresAt = time.Now().Add(-time.Minute)
+	assert.NoError(t, ds.store("key", expired))
+
+	// a fresh value is stored after the expired one was read
+	fresh := newMemEntry([]byte("new"), time.Hour)
+	assert.NoError(t, ds.store("key", fresh))
+	_, removed := ds.removeUnchanged(ds.path("key"), expired.storedAt)
+	assert.False(t, removed)
+
+	entry, err := ds.load("key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), entry.value)
+	info, err := os.Stat(ds.path("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), ds.size())
+}
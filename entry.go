@@ -0,0 +1,104 @@
+package mnemosyne
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const memEntryHeaderSize = 16
+
+// memEntry is a value held by an in-process layer together with the times
+// needed to expire it
+type memEntry struct {
+	value     []byte
+	storedAt  time.Time
+	expiresAt time.Time // zero means the entry never expires
+}
+
+func newMemEntry(value []byte, ttl time.Duration) memEntry {
+	now := time.Now()
+	entry := memEntry{
+		value:    value,
+		storedAt: now,
+	}
+	if ttl > 0 {
+		entry.expiresAt = now.Add(ttl)
+	}
+	return entry
+}
+
+func (e memEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// ttl returns the remaining time to live, or 0 if the entry never expires
+func (e memEntry) ttl(now time.Time) time.Duration {
+	if e.expiresAt.IsZero() {
+		return 0
+	}
+	return e.expiresAt.Sub(now)
+}
+
+// encode serializes the entry for byte-oriented stores such as bigcache
+func (e memEntry) encode() []byte {
+	buf := make([]byte, memEntryHeaderSize+len(e.value))
+	binary.BigEndian.PutUint64(buf[0:8], uint64(e.storedAt.UnixNano()))
+	var expiresAt int64
+	if !e.expiresAt.IsZero() {
+		expiresAt = e.expiresAt.UnixNano()
+	}
+	binary.BigEndian.PutUint64(buf[8:16], uint64(expiresAt))
+	copy(buf[memEntryHeaderSize:], e.value)
+	return buf
+}
+
+func decodeMemEntry(buf []byte) (memEntry, error) {
+	if len(buf) < memEntryHeaderSize {
+		return memEntry{}, errors.New("truncated in-memory entry")
+	}
+	entry := memEntry{
+		value:    buf[memEntryHeaderSize:],
+		storedAt: time.Unix(0, int64(binary.BigEndian.Uint64(buf[0:8]))),
+	}
+	if expiresAt := int64(binary.BigEndian.Uint64(buf[8:16])); expiresAt != 0 {
+		entry.expiresAt = time.Unix(0, expiresAt)
+	}
+	return entry, nil
+}
+
+// janitor runs a cleanup function periodically until closed
+type janitor struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func startJanitor(interval time.Duration, cleanup func()) *janitor {
+	j := &janitor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.stop:
+				return
+			case <-ticker.C:
+				cleanup()
+			}
+		}
+	}()
+	return j
+}
+
+func (j *janitor) close() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+	})
+	<-j.done
+}
@@ -0,0 +1,207 @@
+package mnemosyne
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Stored values start with an envelope header: magic, format version, codec,
+// compression, write time, soft-ttl and recompute cost (all in nanoseconds)
+// and a CRC-32C of the header and payload. The first byte of the magic is neither '{' nor a
+// zlib header, so values stored before envelopes are told apart and read as
+// plain, optionally compressed, JSON.
+const (
+	envelopeMagic      = "\x89MNE"
+	envelopeVersion    = 1
+	envelopeHeaderSize = len(envelopeMagic) + 3 + 8 + 8 + 8 + 4
+
+	codecJSON = 1
+
+	compressionNone = 0
+	compressionZlib = 1
+)
+
+// Storage formats a layer writes values in
+const (
+	// StorageEnvelope writes values in the envelope format
+	StorageEnvelope = "envelope"
+	// StorageLegacy writes plain, optionally compressed, JSON, which versions
+	// from before the envelope format can read. It is meant for rolling
+	// upgrades, values in either format are always read. Legacy values carry
+	// no recompute cost, so early refresh waits for their soft-ttl.
+	StorageLegacy = "legacy"
+)
+
+var (
+	errCorruptEntry  = errors.New("corrupt cache entry")
+	errUnknownFormat = errors.New("unknown cache entry format")
+)
+
+var envelopeTable = crc32.MakeTable(crc32.Castagnoli)
+
+// envelope is the header of a stored value together with its payload
+type envelope struct {
+	version     byte
+	codec       byte
+	compression byte
+	writtenAt   time.Time
+	softTTL     time.Duration
+	// cost is the time it took to compute the value, see SetWithCost
+	cost    time.Duration
+	payload []byte
+}
+
+func (e envelope) encode() []byte {
+	buf := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(e.payload))
+	n := copy(buf, envelopeMagic)
+	buf[n], buf[n+1], buf[n+2] = e.version, e.codec, e.compression
+	binary.BigEndian.PutUint64(buf[n+3:], uint64(e.writtenAt.UnixNano()))
+	binary.BigEndian.PutUint64(buf[n+11:], uint64(e.softTTL))
+	binary.BigEndian.PutUint64(buf[n+19:], uint64(e.cost))
+	buf = append(buf, e.payload...)
+	binary.BigEndian.PutUint32(buf[envelopeHeaderSize-4:], envelopeChecksum(buf))
+	return buf
+}
+
+// envelopeChecksum covers everything but the checksum itself
+func envelopeChecksum(buf []byte) uint32 {
+	crc := crc32.Checksum(buf[:envelopeHeaderSize-4], envelopeTable)
+	return crc32.Update(crc, envelopeTable, buf[envelopeHeaderSize:])
+}
+
+// isEnvelope reports whether buf starts with an envelope header rather than
+// being a legacy value
+func isEnvelope(buf []byte) bool {
+	return len(buf) >= len(envelopeMagic) && string(buf[:len(envelopeMagic)]) == envelopeMagic
+}
+
+// decodeEnvelope validates the header and checksum of buf. Entries of an
+// unknown version, codec or compression are reported as errUnknownFormat.
+func decodeEnvelope(buf []byte) (envelope, error) {
+	if len(buf) < envelopeHeaderSize {
+		return envelope{}, fmt.Errorf("%w: truncated header", errCorruptEntry)
+	}
+	n := len(envelopeMagic)
+	e := envelope{
+		version:     buf[n],
+		codec:       buf[n+1],
+		compression: buf[n+2],
+		writtenAt:   time.Unix(0, int64(binary.BigEndian.Uint64(buf[n+3:]))),
+		softTTL:     time.Duration(binary.BigEndian.Uint64(buf[n+11:])),
+		cost:        time.Duration(binary.BigEndian.Uint64(buf[n+19:])),
+		payload:     buf[envelopeHeaderSize:],
+	}
+	if e.version != envelopeVersion {
+		return envelope{}, fmt.Errorf("%w: version %d", errUnknownFormat, e.version)
+	}
+	if binary.BigEndian.Uint32(buf[envelopeHeaderSize-4:]) != envelopeChecksum(buf) {
+		return envelope{}, fmt.Errorf("%w: checksum mismatch", errCorruptEntry)
+	}
+	switch {
+	case e.codec != codecJSON:
+		return envelope{}, fmt.Errorf("%w: codec %d", errUnknownFormat, e.codec)
+	case e.compression != compressionNone && e.compression != compressionZlib:
+		return envelope{}, fmt.Errorf("%w: compression %d", errUnknownFormat, e.compression)
+	}
+	return e, nil
+}
+
+// newStorageFormat reads the storage-format of a layer from config and
+// reports whether it writes the legacy format
+func newStorageFormat(config *viper.Viper, keyPrefix string) (bool, error) {
+	switch format := config.GetString(keyPrefix + ".storage-format"); format {
+	case "", StorageEnvelope:
+		return false, nil
+	case StorageLegacy:
+		return true, nil
+	default:
+		return false, fmt.Errorf("%w: storage-format must be %s or %s, got %q", ErrInvalidConfig, StorageEnvelope, StorageLegacy, format)
+	}
+}
+
+// encode wraps the JSON of value in an envelope, compressing it if the layer
+// has compression enabled. Layers writing the legacy format leave out the
+// envelope.
+func (cr *cache) encode(value interface{}) ([]byte, error) {
+	var cost time.Duration
+	switch v := value.(type) {
+	case cachable:
+		cost = v.Delta
+	case cachableRet:
+		cost = v.Delta
+	}
+	rawData, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if cr.legacyFormat {
+		if cr.compressionEnabled {
+			return CompressZlib(rawData), nil
+		}
+		return rawData, nil
+	}
+	e := envelope{
+		version:     envelopeVersion,
+		codec:       codecJSON,
+		compression: compressionNone,
+		writtenAt:   time.Now(),
+		softTTL:     cr.softTTL,
+		cost:        cost,
+		payload:     rawData,
+	}
+	if cr.compressionEnabled {
+		e.compression = compressionZlib
+		e.payload = CompressZlib(rawData)
+	}
+	return e.encode(), nil
+}
+
+// decode reads a value written by encode, or a legacy value which is
+// compressed if the layer has compression enabled. Corrupt entries and
+// entries of an unknown format are reported as errCorruptEntry and
+// errUnknownFormat.
+func (cr *cache) decode(rawBytes []byte) (*cachableRet, error) {
+	payload, compressed := rawBytes, cr.compressionEnabled
+	var cost time.Duration
+	if isEnvelope(rawBytes) {
+		e, err := decodeEnvelope(rawBytes)
+		if err != nil {
+			return nil, err
+		}
+		payload, compressed, cost = e.payload, e.compression == compressionZlib, e.cost
+	}
+	if compressed {
+		var err error
+		if payload, err = decompressZlib(payload); err != nil {
+			return nil, fmt.Errorf("%w: %v", errCorruptEntry, err)
+		}
+	}
+	var finalObject cachableRet
+	if err := json.Unmarshal(payload, &finalObject); err != nil {
+		return nil, fmt.Errorf("%w: failed to unmarshall cached value : %v", errCorruptEntry, err)
+	}
+	finalObject.Delta = cost
+	return &finalObject, nil
+}
+
+// corrupted reports a value of key which could not be decoded. Reads of it
+// fall through to the next layer, so it is counted and logged, sampled, to
+// tell it apart from a miss.
+func (cr *cache) corrupted(key string, err error) {
+	cr.observer.Observe(Corrupt{Instance: cr.instanceName, Layer: cr.layerName, Err: err})
+	if ok, suppressed := cr.corruptLog.shouldLog(time.Now()); ok {
+		logrus.WithError(err).
+			WithField("cache", cr.instanceName).
+			WithField("layer", cr.layerName).
+			WithField("key_hash", keyHash(key)).
+			WithField("suppressed", suppressed).
+			Warn("cannot decode value stored in layer")
+	}
+}
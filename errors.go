@@ -10,4 +10,8 @@ var (
 	ErrLayerNotFound = errors.New("cache layer not found")
 	ErrInvalidConfig = errors.New("invalid cache configuration")
 	ErrNotFound      = errors.New("not found in any layer")
+	ErrCircuitOpen   = errors.New("circuit breaker of layer is open")
+	ErrLeaseHeld     = errors.New("refresh lease is held by another process")
+	ErrNoRedisLayer  = errors.New("cache instance has no redis layer")
+	ErrValueTooLarge = errors.New("value exceeds max-value-size of layer")
 )
@@ -0,0 +1,356 @@
+package mnemosyne
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+)
+
+// evictionPolicy decides which key a bounded tiny layer drops when it is over
+// its limits. Policies are not safe for concurrent use; the store serializes
+// access to them.
+type evictionPolicy interface {
+	// add registers a key which was just inserted
+	add(key string)
+	// access registers a read or an overwrite of an existing key
+	access(key string)
+	// remove forgets a key which was deleted or evicted
+	remove(key string)
+	// victim returns the key which should be evicted next
+	victim() (string, bool)
+	reset()
+}
+
+// newEvictionPolicy returns the policy called name for a store holding at
+// most maxEntries keys, or any number of keys if maxEntries is not positive
+func newEvictionPolicy(name string, maxEntries int) (evictionPolicy, error) {
+	switch name {
+	case "", "lru":
+		return newLRUPolicy(), nil
+	case "lfu":
+		return newLFUPolicy(), nil
+	case "tinylfu", "w-tinylfu":
+		return newTinyLFUPolicy(maxEntries), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown eviction policy %q", ErrInvalidConfig, name)
+	}
+}
+
+// lruPolicy evicts the least recently used key
+type lruPolicy struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+func (p *lruPolicy) add(key string) {
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) access(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) remove(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.Remove(elem)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) victim() (string, bool) {
+	if back := p.order.Back(); back != nil {
+		return back.Value.(string), true
+	}
+	return "", false
+}
+
+func (p *lruPolicy) reset() {
+	p.order.Init()
+	p.elems = make(map[string]*list.Element)
+}
+
+// lfuPolicy evicts the least frequently used key, breaking ties by recency
+type lfuPolicy struct {
+	items map[string]*lfuItem
+	queue lfuQueue
+	clock uint64
+}
+
+type lfuItem struct {
+	key   string
+	freq  uint64
+	seq   uint64
+	index int
+}
+
+type lfuQueue []*lfuItem
+
+func (q lfuQueue) Len() int { return len(q) }
+func (q lfuQueue) Less(i, j int) bool {
+	if q[i].freq != q[j].freq {
+		return q[i].freq < q[j].freq
+	}
+	return q[i].seq < q[j].seq
+}
+func (q lfuQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *lfuQueue) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *lfuQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{
+		items: make(map[string]*lfuItem),
+	}
+}
+
+func (p *lfuPolicy) add(key string) {
+	p.clock++
+	item := &lfuItem{key: key, freq: 1, seq: p.clock}
+	p.items[key] = item
+	heap.Push(&p.queue, item)
+}
+
+func (p *lfuPolicy) access(key string) {
+	if item, ok := p.items[key]; ok {
+		p.clock++
+		item.freq++
+		item.seq = p.clock
+		heap.Fix(&p.queue, item.index)
+	}
+}
+
+func (p *lfuPolicy) remove(key string) {
+	if item, ok := p.items[key]; ok {
+		heap.Remove(&p.queue, item.index)
+		delete(p.items, key)
+	}
+}
+
+func (p *lfuPolicy) victim() (string, bool) {
+	if len(p.queue) == 0 {
+		return "", false
+	}
+	return p.queue[0].key, true
+}
+
+func (p *lfuPolicy) reset() {
+	p.items = make(map[string]*lfuItem)
+	p.queue = nil
+}
+
+// tinyLFUPolicy is a W-TinyLFU policy: new keys enter a small LRU window and
+// keys leaving the window are only admitted into the segmented LRU main area
+// if their estimated frequency beats the main area's victim
+type tinyLFUPolicy struct {
+	sketch    *countMinSketch
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	elems     map[string]*tinyLFUElem
+	candidate string
+	// capacity is the number of keys the segments are sized for. Without a
+	// configured max-entries it is the most keys held so far, so the
+	// segments do not shrink with evictions.
+	capacity int
+	bounded  bool
+}
+
+type tinyLFUElem struct {
+	elem    *list.Element
+	segment *list.List
+}
+
+func newTinyLFUPolicy(maxEntries int) *tinyLFUPolicy {
+	return &tinyLFUPolicy{
+		sketch:    newCountMinSketch(maxEntries),
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		elems:     make(map[string]*tinyLFUElem),
+		capacity:  max(maxEntries, 0),
+		bounded:   maxEntries > 0,
+	}
+}
+
+// the window holds 1% of the capacity and the protected segment 80% of the
+// rest
+func (p *tinyLFUPolicy) windowCap() int {
+	return max(1, p.capacity/100)
+}
+
+func (p *tinyLFUPolicy) protectedCap() int {
+	return max(1, (p.capacity-p.windowCap())*8/10)
+}
+
+func (p *tinyLFUPolicy) move(key string, e *tinyLFUElem, to *list.List) {
+	e.segment.Remove(e.elem)
+	e.segment = to
+	e.elem = to.PushFront(key)
+}
+
+func (p *tinyLFUPolicy) add(key string) {
+	p.sketch.increment(key)
+	p.elems[key] = &tinyLFUElem{elem: p.window.PushFront(key), segment: p.window}
+	if !p.bounded {
+		p.capacity = max(p.capacity, len(p.elems))
+	}
+	for p.window.Len() > p.windowCap() {
+		candidate := p.window.Back().Value.(string)
+		p.move(candidate, p.elems[candidate], p.probation)
+		p.candidate = candidate
+	}
+}
+
+func (p *tinyLFUPolicy) access(key string) {
+	p.sketch.increment(key)
+	e, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	switch e.segment {
+	case p.window, p.protected:
+		e.segment.MoveToFront(e.elem)
+	case p.probation:
+		p.move(key, e, p.protected)
+		for p.protected.Len() > p.protectedCap() {
+			demoted := p.protected.Back().Value.(string)
+			p.move(demoted, p.elems[demoted], p.probation)
+		}
+	}
+}
+
+func (p *tinyLFUPolicy) remove(key string) {
+	if e, ok := p.elems[key]; ok {
+		e.segment.Remove(e.elem)
+		delete(p.elems, key)
+	}
+	if p.candidate == key {
+		p.candidate = ""
+	}
+}
+
+func (p *tinyLFUPolicy) victim() (string, bool) {
+	candidate := p.candidate
+	p.candidate = ""
+	if back := p.probation.Back(); back != nil {
+		victim := back.Value.(string)
+		if e, ok := p.elems[candidate]; ok && e.segment == p.probation && candidate != victim {
+			// admit the candidate only if it is used more often than the victim
+			if p.sketch.estimate(candidate) > p.sketch.estimate(victim) {
+				return victim, true
+			}
+			return candidate, true
+		}
+		return victim, true
+	}
+	if back := p.protected.Back(); back != nil {
+		return back.Value.(string), true
+	}
+	if back := p.window.Back(); back != nil {
+		return back.Value.(string), true
+	}
+	return "", false
+}
+
+func (p *tinyLFUPolicy) reset() {
+	p.sketch.clear()
+	p.window.Init()
+	p.probation.Init()
+	p.protected.Init()
+	p.elems = make(map[string]*tinyLFUElem)
+	p.candidate = ""
+	if !p.bounded {
+		p.capacity = 0
+	}
+}
+
+// countMinSketch estimates key frequencies with 4-bit saturating counters
+// which are halved periodically so that old popularity fades away
+type countMinSketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := 1
+	for width < max(capacity, 1024) {
+		width <<= 1
+	}
+	s := &countMinSketch{
+		mask:       uint64(width - 1),
+		sampleSize: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) [4]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	var idx [4]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i, idx := range s.indexes(key) {
+		if s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	est := uint8(15)
+	for i, idx := range s.indexes(key) {
+		est = min(est, s.rows[i][idx])
+	}
+	return est
+}
+
+func (s *countMinSketch) clear() {
+	for i := range s.rows {
+		clear(s.rows[i])
+	}
+	s.additions = 0
+}
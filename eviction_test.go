@@ -0,0 +1,29 @@
+package mnemosyne
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTinyLFUSegmentsFollowCapacity(t *testing.T) {
+	p := newTinyLFUPolicy(1000)
+	for i := range 10 {
+		p.add(fmt.Sprintf("key_%d", i))
+	}
+	assert.Equal(t, 10, p.window.Len(), "the window should hold 1% of max-entries while the store fills up")
+	assert.Equal(t, 792, p.protectedCap())
+
+	p.remove("key_0")
+	assert.Equal(t, 10, p.windowCap(), "evictions should not shrink the window")
+
+	unbounded := newTinyLFUPolicy(0)
+	for i := range 500 {
+		unbounded.add(fmt.Sprintf("key_%d", i))
+	}
+	for i := range 400 {
+		unbounded.remove(fmt.Sprintf("key_%d", i))
+	}
+	assert.Equal(t, 5, unbounded.windowCap(), "without max-entries the segments follow the most keys held")
+}
@@ -0,0 +1,132 @@
+package mnemosyne
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+const defaultHedgeDelay = 10 * time.Millisecond
+
+// hedgePolicy sends a second read to another node of a guardian layer when
+// the first one is slower than the given percentile of recent reads
+type hedgePolicy struct {
+	percentile float64
+	// initialDelay is used until latencies have been recorded
+	initialDelay time.Duration
+	latencies    *latencyWindow
+}
+
+// newHedgePolicy reads the hedging of a layer from config and returns nil if
+// reads should not be hedged
+func newHedgePolicy(config *viper.Viper, keyPrefix string) (*hedgePolicy, error) {
+	percentile := config.GetFloat64(keyPrefix + ".hedge-percentile")
+	initialDelay := defaultHedgeDelay
+	if config.IsSet(keyPrefix + ".hedge-delay") {
+		initialDelay = config.GetDuration(keyPrefix + ".hedge-delay")
+	}
+	switch {
+	case percentile < 0 || percentile >= 100:
+		return nil, fmt.Errorf("%w: hedge-percentile must be between 0 and 100, got %v", ErrInvalidConfig, percentile)
+	case initialDelay <= 0:
+		return nil, fmt.Errorf("%w: hedge-delay must be positive, got %v", ErrInvalidConfig, initialDelay)
+	}
+	if percentile == 0 {
+		return nil, nil
+	}
+	return &hedgePolicy{
+		percentile:   percentile,
+		initialDelay: initialDelay,
+		latencies:    newLatencyWindow(latencySamples),
+	}, nil
+}
+
+func (hp *hedgePolicy) delay() time.Duration {
+	if d, ok := hp.latencies.percentile(hp.percentile); ok {
+		return d
+	}
+	return hp.initialDelay
+}
+
+type hedgeResult struct {
+	value  string
+	err    error
+	hedged bool
+}
+
+// hedgedGet reads key from primary and, if it has not answered within the
+// hedge delay, also from another node of the layer, returning the first
+// answer. A miss is an answer; an error waits for the other read.
+func (cr *cache) hedgedGet(ctx context.Context, primary *redis.Client, key string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	read := func(client *redis.Client, hedged bool) {
+		startMarker := time.Now()
+		value, err := client.Get(ctx, key).Result()
+		// a primary cancelled after losing or timing out took at least
+		// as long as it ran, leaving it out would drag the percentile down
+		if err == nil || errors.Is(err, redis.Nil) || (!hedged && unanswered(err)) {
+			cr.hedge.latencies.add(time.Since(startMarker))
+		}
+		results <- hedgeResult{value: value, err: err, hedged: hedged}
+	}
+	go read(primary, false)
+
+	timer := time.NewTimer(cr.hedge.delay())
+	defer timer.Stop()
+	outstanding, hedged := 1, false
+	for {
+		select {
+		case <-timer.C:
+			if secondary := cr.hedgeClient(primary); secondary != nil {
+				outstanding++
+				hedged = true
+				go read(secondary, true)
+			}
+		case res := <-results:
+			outstanding--
+			answered := res.err == nil || errors.Is(res.err, redis.Nil)
+			if !answered && outstanding > 0 {
+				continue
+			}
+			if hedged {
+				cr.observer.Observe(Hedge{Instance: cr.instanceName, Layer: cr.layerName, Won: res.hedged})
+			}
+			return res.value, res.err
+		}
+	}
+}
+
+// unanswered reports whether a read was cut short rather than failed
+func unanswered(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// hedgeClient returns a node of the layer other than primary, or nil if
+// there is none
+func (cr *cache) hedgeClient(primary *redis.Client) *redis.Client {
+	slaves := cr.slaves()
+	candidates := make([]*redis.Client, 0, len(slaves)+1)
+	if cr.baseRedisClient != primary {
+		candidates = append(candidates, cr.baseRedisClient)
+	}
+	for _, client := range slaves {
+		if client != primary {
+			candidates = append(candidates, client)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
@@ -0,0 +1,51 @@
+package mnemosyne
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHedgeRecordsSlowPrimaries(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		// accept connections but never answer
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+	master := miniredis.RunT(t)
+	assert.NoError(t, master.Set("key", "value"))
+
+	cr := newCacheClusterRedis("guardian", master.Addr(), nil, 0, time.Hour, 0, 0, 0, 0, nil, 0, false)
+	cr.observer = combineObservers()
+	cr.tracer = noopTracer{}
+	cr.hedge = &hedgePolicy{percentile: 90, initialDelay: 20 * time.Millisecond, latencies: newLatencyWindow(latencySamples)}
+	stuck := redis.NewClient(&redis.Options{Addr: listener.Addr().String(), ReadTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() {
+		_ = stuck.Close()
+		_ = cr.close()
+	})
+
+	value, err := cr.hedgedGet(context.Background(), stuck, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	// the hedge answered quickly, the primary is recorded once it times out
+	assert.Eventually(t, func() bool {
+		return len(cr.hedge.latencies.sorted()) == 2
+	}, time.Second, 5*time.Millisecond)
+	slowest := cr.hedge.latencies.sorted()[1]
+	assert.GreaterOrEqual(t, slowest, 100*time.Millisecond)
+}
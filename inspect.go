@@ -0,0 +1,103 @@
+package mnemosyne
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// LayerInfo describes a layer of a cache instance
+type LayerInfo struct {
+	Name string
+	Type string
+}
+
+// LayerEntry describes the state of a key in one layer
+type LayerEntry struct {
+	Layer   string
+	Present bool
+	// Age is the time since the value was cached, TTL its remaining time to live
+	Age  time.Duration
+	TTL  time.Duration
+	Size int
+	// CachedAt is the time the value was originally written to the instance,
+	// WrittenAt the time it was written to this layer. WrittenAt and SoftTTL,
+	// the soft-ttl of the instance at that time, are not known for values
+	// stored before the envelope format, nor is Cost, the recompute cost
+	// recorded by SetWithCost.
+	CachedAt  time.Time
+	WrittenAt time.Time
+	SoftTTL   time.Duration
+	Cost      time.Duration
+	Value     json.RawMessage
+	Error     string
+}
+
+// Layers returns the layers of the instance in order of precedence
+func (mn *MnemosyneInstance) Layers() []LayerInfo {
+	layers := make([]LayerInfo, len(mn.cacheLayers))
+	for i, layer := range mn.cacheLayers {
+		layers[i] = LayerInfo{Name: layer.layerName, Type: layer.kind()}
+	}
+	return layers
+}
+
+// Inspect reports the state of key in every layer of the instance. Unlike
+// Get it ignores amnesia, does not fill upper layers and is not counted in
+// the statistics and metrics of the layers.
+func (mn *MnemosyneInstance) Inspect(ctx context.Context, key string) []LayerEntry {
+	entries := make([]LayerEntry, len(mn.cacheLayers))
+	for i, layer := range mn.cacheLayers {
+		entries[i] = layer.withContext(ctx).inspect(key)
+	}
+	return entries
+}
+
+func (cr *cache) inspect(key string) LayerEntry {
+	entry := LayerEntry{Layer: cr.layerName}
+	rawBytes, err := cr.fetch(cr.ctx, key)
+	if err != nil {
+		// tell a failing layer apart from a missing key
+		if outcome(err) == "error" {
+			entry.Error = err.Error()
+		}
+		return entry
+	}
+	entry.Present = true
+	entry.Size = len(rawBytes)
+	entry.TTL, _ = cr.remainingTTL(key)
+
+	value, err := cr.decode(rawBytes)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.CachedAt = value.Time
+	if isEnvelope(rawBytes) {
+		if e, err := decodeEnvelope(rawBytes); err == nil {
+			entry.WrittenAt = e.writtenAt
+			entry.SoftTTL = e.softTTL
+			entry.Cost = e.cost
+		}
+	}
+	entry.Age = time.Since(value.Time)
+	if value.CachedObject != nil {
+		entry.Value = *value.CachedObject
+	}
+	return entry
+}
+
+func (cr *cache) kind() string {
+	switch {
+	case cr.disk != nil:
+		return "disk"
+	case cr.tiny != nil:
+		return "tiny"
+	case cr.inMemCache != nil:
+		return "memory"
+	case cr.slaveRedisClients != nil:
+		return "guardian"
+	default:
+		return "redis"
+	}
+}
@@ -0,0 +1,183 @@
+package mnemosyne
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"strings"
+	"time"
+)
+
+const scanBatchSize = 1000
+
+// Keys iterates over the keys held by the named layer which match pattern,
+// a Redis-style glob ("*", "?", "[...]" and "\" escapes). An empty pattern
+// matches every key. Redis-backed layers are walked with SCAN on the master,
+// so keys may be reported more than once if the keyspace changes meanwhile.
+// The refresh leases kept next to the values are left out.
+//
+// Keys are stored without a prefix, an instance is only kept apart from
+// others by the address and db of its layers. SCAN is limited to the db of
+// the layer, but keys written to the same db by other instances or services
+// are listed as well.
+func (mn *MnemosyneInstance) Keys(ctx context.Context, layerName, pattern string) iter.Seq2[string, error] {
+	for _, layer := range mn.cacheLayers {
+		if layer.layerName == layerName {
+			return layer.keys(ctx, pattern)
+		}
+	}
+	return func(yield func(string, error) bool) {
+		yield("", fmt.Errorf("%w: %s", ErrLayerNotFound, layerName))
+	}
+}
+
+func (cr *cache) keys(ctx context.Context, pattern string) iter.Seq2[string, error] {
+	if pattern == "" {
+		pattern = "*"
+	}
+	return func(yield func(string, error) bool) {
+		switch {
+		case cr.disk != nil:
+			now := time.Now()
+			cr.disk.each(func(key string, entry memEntry) bool {
+				if err := ctx.Err(); err != nil {
+					yield("", err)
+					return false
+				}
+				if entry.expired(now) || !matchPattern(pattern, key) {
+					return true
+				}
+				return yield(key, nil)
+			})
+
+		case cr.tiny != nil:
+			now := time.Now()
+			cr.tiny.each(func(key string, entry *memEntry) bool {
+				if err := ctx.Err(); err != nil {
+					yield("", err)
+					return false
+				}
+				if entry.expired(now) || !matchPattern(pattern, key) {
+					return true
+				}
+				return yield(key, nil)
+			})
+
+		case cr.inMemCache != nil:
+			now := time.Now()
+			it := cr.inMemCache.Iterator()
+			for it.SetNext() {
+				if err := ctx.Err(); err != nil {
+					yield("", err)
+					return
+				}
+				info, err := it.Value()
+				if err != nil {
+					// the entry was removed while iterating
+					continue
+				}
+				if entry, err := decodeMemEntry(info.Value()); err != nil || entry.expired(now) {
+					continue
+				}
+				if matchPattern(pattern, info.Key()) && !yield(info.Key(), nil) {
+					return
+				}
+			}
+
+		default:
+			it := cr.baseRedisClient.Scan(ctx, 0, pattern, scanBatchSize).Iterator()
+			for it.Next(ctx) {
+				if strings.HasPrefix(it.Val(), leaseKeyPrefix) {
+					continue
+				}
+				if !yield(it.Val(), nil) {
+					return
+				}
+			}
+			if err := it.Err(); err != nil {
+				yield("", err)
+			}
+		}
+	}
+}
+
+// matchPattern reports whether key matches a Redis-style glob pattern. It
+// backtracks to the last '*' only, so patterns from admin requests take time
+// linear in the key per star.
+func matchPattern(pattern, key string) bool {
+	p, k := 0, 0
+	star, starKey := -1, 0
+	for k < len(key) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			star, starKey = p, k
+			continue
+		}
+		if p < len(pattern) {
+			if width, ok := matchOne(pattern[p:], key[k]); ok {
+				p, k = p+width, k+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// let the last star take one more byte of the key
+		starKey++
+		p, k = star, starKey
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchOne matches c against the element at the start of pattern, which is
+// not a star, and returns the length of the element
+func matchOne(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		return matchClass(pattern, c)
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+// matchClass matches c against the character class at the start of pattern
+// and returns the length of the class
+func matchClass(pattern string, c byte) (int, bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+	matched := false
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			matched = matched || pattern[i] == c
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			i += 2
+		default:
+			matched = matched || pattern[i] == c
+		}
+	}
+	if i < len(pattern) {
+		// skip the closing bracket
+		i++
+	}
+	return i, matched != negate
+}
@@ -0,0 +1,48 @@
+package mnemosyne
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "", true},
+		{"*", "user:1", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"*:1", "user:1", true},
+		{"*:1", "user:12", false},
+		{"u*r:*1", "user:21", true},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"user:[0-4]", "user:3", true},
+		{"user:[0-4]", "user:7", false},
+		{"user:[^0-4]", "user:7", true},
+		{"user:[ab]*", "user:b1", true},
+		{`user\*`, "user*", true},
+		{`user\*`, "users", false},
+		{"a**b", "ab", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchPattern(tt.pattern, tt.key), "%q against %q", tt.pattern, tt.key)
+	}
+}
+
+func TestMatchPatternBacktracking(t *testing.T) {
+	key := strings.Repeat("a", 200)
+	pattern := strings.Repeat("*a", 20) + "*b"
+	start := time.Now()
+	assert.False(t, matchPattern(pattern, key))
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "matching should not backtrack exponentially")
+}
@@ -0,0 +1,209 @@
+package mnemosyne
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLeaseTTL  = 10 * time.Second
+	leasePollDelay   = 25 * time.Millisecond
+	leaseKeyPrefix   = "mnemosyne-lease:"
+	leaseTokenLength = 16
+)
+
+// releaseLease deletes a lease only if it still holds the caller's token, so
+// a lease which expired and was taken over by another process is left alone
+var releaseLease = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// RefreshLease is the right to recompute a key, held by a single process
+// until it is released or its ttl passes
+type RefreshLease struct {
+	layer *cache
+	key   string
+	token string
+}
+
+// AcquireRefreshLease takes the lease to recompute key for ttl on the lowest
+// Redis layer of the instance, which all processes share. It returns
+// ErrLeaseHeld if another process holds the lease and ErrNoRedisLayer if the
+// instance has no Redis layer. The ttl must be positive, a lease without
+// expiry would outlive a holder which crashed.
+func (mn *MnemosyneInstance) AcquireRefreshLease(ctx context.Context, key string, ttl time.Duration) (*RefreshLease, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("lease ttl must be positive, got %v", ttl)
+	}
+	layer := mn.leaseLayer()
+	if layer == nil {
+		return nil, ErrNoRedisLayer
+	}
+	token := make([]byte, leaseTokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	lease := &RefreshLease{layer: layer, key: leaseKeyPrefix + key, token: hex.EncodeToString(token)}
+
+	var acquired bool
+	err := layer.redisCall(ctx, "lease", func() (err error) {
+		acquired, err = layer.baseRedisClient.SetNX(ctx, lease.key, lease.token, ttl).Result()
+		if err != nil || acquired {
+			return err
+		}
+		// a retried SET, by redisCall or by the client, finds the lease taken
+		// by an earlier attempt whose reply was lost
+		held, err := layer.baseRedisClient.Get(ctx, lease.key).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		acquired = held == lease.token
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, ErrLeaseHeld
+	}
+	return lease, nil
+}
+
+// Release gives up the lease if it is still held by this process
+func (l *RefreshLease) Release(ctx context.Context) error {
+	return l.layer.redisCall(ctx, "lease", func() error {
+		return releaseLease.Run(ctx, l.layer.baseRedisClient, []string{l.key}, l.token).Err()
+	})
+}
+
+// leaseLayer returns the lowest Redis layer of the instance, or nil
+func (mn *MnemosyneInstance) leaseLayer() *cache {
+	for i := len(mn.cacheLayers) - 1; i >= 0; i-- {
+		if mn.cacheLayers[i].baseRedisClient != nil {
+			return mn.cacheLayers[i]
+		}
+	}
+	return nil
+}
+
+// GetOrLoad retrieves the value for key into ref, calling load to compute it
+// when it is missing or due for an update. Across processes only the holder
+// of the refresh lease calls load: the others keep serving a stale value, or
+// wait for the value to appear when there is none. The value returned by
+// load is stored together with the time it took to compute. Only an instance
+// without a Redis layer loads without a lease: if the Redis layer fails,
+// GetOrLoad waits up to the lease ttl for it to recover and then returns the
+// error.
+func (mn *MnemosyneInstance) GetOrLoad(ctx context.Context, key string, ref interface{}, load func(context.Context) (interface{}, error)) error {
+	cached, err := mn.get(ctx, key)
+	if err == nil && cached.CachedObject != nil {
+		if !mn.shouldUpdate(cached) {
+			return json.Unmarshal(*cached.CachedObject, ref)
+		}
+		lease, err := mn.AcquireRefreshLease(ctx, key, mn.leaseTTL)
+		if err != nil && !errors.Is(err, ErrNoRedisLayer) {
+			// someone else refreshes the value, or nobody can tell
+			return json.Unmarshal(*cached.CachedObject, ref)
+		}
+		defer mn.releaseLease(lease)
+		if err := mn.load(ctx, key, ref, load); err != nil {
+			logrus.WithError(err).WithField("cache", mn.name).
+				WithField("key_hash", keyHash(key)).
+				Warn("failed to refresh value, serving the stale one")
+			return json.Unmarshal(*cached.CachedObject, ref)
+		}
+		return nil
+	}
+
+	var unhealthySince time.Time
+	for {
+		lease, err := mn.AcquireRefreshLease(ctx, key, mn.leaseTTL)
+		switch {
+		case err == nil || errors.Is(err, ErrNoRedisLayer):
+			defer mn.releaseLease(lease)
+			return mn.load(ctx, key, ref, load)
+		case errors.Is(err, ErrLeaseHeld):
+			unhealthySince = time.Time{}
+		case unhealthySince.IsZero():
+			// loading without a lease while the lease layer is unhealthy
+			// would let every process recompute at once, wait for it to
+			// recover for up to a lease ttl
+			unhealthySince = time.Now()
+		case time.Since(unhealthySince) > mn.leaseTTL:
+			return fmt.Errorf("failed to acquire refresh lease: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(leasePollDelay):
+		}
+		// waiting is not traffic of the layers, only the read which finds
+		// the value is counted
+		if value := mn.peek(ctx, key); value != nil {
+			if cached, err := mn.get(ctx, key); err == nil && cached.CachedObject != nil {
+				value = cached
+			}
+			return json.Unmarshal(*value.CachedObject, ref)
+		}
+	}
+}
+
+// peek returns the value of key from the first layer which holds it, or nil.
+// Like Inspect it ignores amnesia and is not counted in the statistics.
+func (mn *MnemosyneInstance) peek(ctx context.Context, key string) *cachableRet {
+	for _, layer := range mn.cacheLayers {
+		layer := layer.withContext(ctx)
+		rawBytes, err := layer.fetch(ctx, key)
+		if err != nil {
+			continue
+		}
+		if value, err := layer.decode(rawBytes); err == nil && value.CachedObject != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+func (mn *MnemosyneInstance) load(ctx context.Context, key string, ref interface{}, load func(context.Context) (interface{}, error)) error {
+	startMarker := time.Now()
+	value, err := load(ctx)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return ErrNilValue
+	}
+	if err := mn.SetWithCost(ctx, key, value, time.Since(startMarker)); err != nil {
+		logrus.WithError(err).WithField("cache", mn.name).
+			WithField("key_hash", keyHash(key)).
+			Warn("failed to cache loaded value")
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal loaded value: %w", err)
+	}
+	return json.Unmarshal(raw, ref)
+}
+
+func (mn *MnemosyneInstance) releaseLease(lease *RefreshLease) {
+	if lease == nil {
+		return
+	}
+	// release even if the caller's context is already done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := lease.Release(ctx); err != nil {
+		logrus.WithError(err).WithField("cache", mn.name).Warn("failed to release refresh lease")
+	}
+}
@@ -0,0 +1,119 @@
+package mnemosyne
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultMemoryShards             = 1024
+	defaultMemoryMaxEntriesInWindow = 1100 * 10 * 60
+	defaultMemoryMaxEntrySize       = 500
+	defaultMemoryCleanWindow        = 1 * time.Minute
+)
+
+// MemoryStats are the statistics of a memory layer
+type MemoryStats struct {
+	// Hits, Misses, DelHits, DelMisses and Collisions are reported by bigcache
+	Hits       int64
+	Misses     int64
+	DelHits    int64
+	DelMisses  int64
+	Collisions int64
+	// Expired is the number of entries removed after their life window
+	Expired int64
+	// Evicted is the number of entries removed to make room for new ones
+	Evicted int64
+	// Entries is the number of entries currently stored
+	Entries int
+	// Capacity is the number of bytes allocated by the layer
+	Capacity int
+}
+
+// memoryRemovals counts the entries bigcache removed on its own
+type memoryRemovals struct {
+	expired atomic.Int64
+	evicted atomic.Int64
+}
+
+// newMemoryConfig reads and validates the bigcache tuning of a memory layer
+func newMemoryConfig(config *viper.Viper, keyPrefix string) (bigcache.Config, error) {
+	opts := bigcache.Config{
+		Shards:             defaultMemoryShards,
+		LifeWindow:         config.GetDuration(keyPrefix + ".ttl"),
+		MaxEntriesInWindow: defaultMemoryMaxEntriesInWindow,
+		MaxEntrySize:       defaultMemoryMaxEntrySize,
+		Verbose:            false,
+		HardMaxCacheSize:   config.GetInt(keyPrefix + ".max-memory"),
+		CleanWindow:        defaultMemoryCleanWindow,
+	}
+	if config.IsSet(keyPrefix + ".shards") {
+		opts.Shards = config.GetInt(keyPrefix + ".shards")
+	}
+	if config.IsSet(keyPrefix + ".max-entries-in-window") {
+		opts.MaxEntriesInWindow = config.GetInt(keyPrefix + ".max-entries-in-window")
+	}
+	if config.IsSet(keyPrefix + ".max-entry-size") {
+		opts.MaxEntrySize = config.GetInt(keyPrefix + ".max-entry-size")
+	}
+	if config.IsSet(keyPrefix + ".clean-window") {
+		opts.CleanWindow = config.GetDuration(keyPrefix + ".clean-window")
+	}
+
+	switch {
+	case opts.Shards <= 0 || opts.Shards&(opts.Shards-1) != 0:
+		return opts, fmt.Errorf("%w: shards must be a positive power of two, got %d", ErrInvalidConfig, opts.Shards)
+	case opts.MaxEntriesInWindow <= 0:
+		return opts, fmt.Errorf("%w: max-entries-in-window must be positive, got %d", ErrInvalidConfig, opts.MaxEntriesInWindow)
+	case opts.MaxEntrySize <= 0:
+		return opts, fmt.Errorf("%w: max-entry-size must be positive, got %d", ErrInvalidConfig, opts.MaxEntrySize)
+	case opts.CleanWindow < 0:
+		return opts, fmt.Errorf("%w: clean-window must not be negative, got %v", ErrInvalidConfig, opts.CleanWindow)
+	case opts.HardMaxCacheSize < 0:
+		return opts, fmt.Errorf("%w: max-memory must not be negative, got %d", ErrInvalidConfig, opts.HardMaxCacheSize)
+	}
+	return opts, nil
+}
+
+// onRemove returns a bigcache removal callback which counts expirations and
+// evictions and reports them through evicted
+func (mr *memoryRemovals) onRemove(evicted func(reason string)) func(string, []byte, bigcache.RemoveReason) {
+	return func(_ string, _ []byte, reason bigcache.RemoveReason) {
+		switch reason {
+		case bigcache.Expired:
+			mr.expired.Add(1)
+			evicted("expired")
+		case bigcache.NoSpace:
+			mr.evicted.Add(1)
+			evicted("capacity")
+		}
+	}
+}
+
+// sampleMemory emits a MemorySample for every memory layer of the instance
+func (mn *MnemosyneInstance) sampleMemory() {
+	for _, layer := range mn.cacheLayers {
+		if layer.inMemCache != nil {
+			mn.observer.Observe(MemorySample{Instance: mn.name, Layer: layer.layerName, Stats: layer.memoryStats()})
+		}
+	}
+}
+
+func (cr *cache) memoryStats() MemoryStats {
+	stats := cr.inMemCache.Stats()
+	return MemoryStats{
+		Hits:       stats.Hits,
+		Misses:     stats.Misses,
+		DelHits:    stats.DelHits,
+		DelMisses:  stats.DelMisses,
+		Collisions: stats.Collisions,
+		Expired:    cr.memRemovals.expired.Load(),
+		Evicted:    cr.memRemovals.evicted.Load(),
+		Entries:    cr.inMemCache.Len(),
+		Capacity:   cr.inMemCache.Capacity(),
+	}
+}
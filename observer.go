@@ -0,0 +1,250 @@
+package mnemosyne
+
+import (
+	"time"
+)
+
+// Observer receives the events emitted by cache instances and their layers.
+// Observe is called synchronously on the cache's hot path and from multiple
+// goroutines, so implementations must be fast and safe for concurrent use.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc adapts a function to the Observer interface
+type ObserverFunc func(Event)
+
+// Observe calls f(event)
+func (f ObserverFunc) Observe(event Event) {
+	f(event)
+}
+
+// Event is one of Hit, Miss, Hotness, GetDone, SetDone, OpDone, Fill, Evict,
+// Amnesia, BreakerChange, Retry, Hedge, Oversize, Corrupt or MemorySample
+type Event interface {
+	event()
+}
+
+// Hit is emitted when a read of the instance is served by a layer
+type Hit struct {
+	Instance string
+	Layer    string
+	// Index is the position of the layer in the instance
+	Index int
+	// Age is the time since the value was cached
+	Age time.Duration
+}
+
+// Miss is emitted when a read of the instance misses every layer
+type Miss struct {
+	Instance string
+}
+
+// Hotness classifies the age of data read through GetAndShouldUpdate as
+// "hot" (within soft-ttl), "warm" (within twice soft-ttl) or "cold"
+type Hotness struct {
+	Instance string
+	Level    string
+	Age      time.Duration
+}
+
+// GetDone is emitted after a layer was read. Result is "ok", "miss",
+// "corrupt" or "error".
+type GetDone struct {
+	Instance string
+	Layer    string
+	Result   string
+	Bytes    int
+	Err      error
+	Duration time.Duration
+}
+
+// SetDone is emitted after a value was written to a layer. Bytes is the size
+// of the stored value, after compression if Compressed is set.
+type SetDone struct {
+	Instance   string
+	Layer      string
+	Bytes      int
+	Compressed bool
+	Err        error
+	Duration   time.Duration
+}
+
+// OpDone is emitted after a delete, clear or ttl operation on a layer.
+// Result is "ok", "miss" or "error".
+type OpDone struct {
+	Instance string
+	Layer    string
+	Op       string
+	Result   string
+	Err      error
+	Duration time.Duration
+}
+
+// Fill is emitted when an upper layer is back-filled with a value read from
+// a lower layer
+type Fill struct {
+	Instance string
+	Layer    string
+	From     string
+	Err      error
+}
+
+// Evict is emitted when an in-process layer drops an entry on its own.
+// Reason is "capacity" or "expired".
+type Evict struct {
+	Instance string
+	Layer    string
+	Reason   string
+}
+
+// Amnesia is emitted when a read of a layer deliberately misses because of
+// its amnesia setting
+type Amnesia struct {
+	Instance string
+	Layer    string
+}
+
+// BreakerChange is emitted when the circuit breaker of a Redis layer changes
+// state. From and To are BreakerClosed, BreakerOpen or BreakerHalfOpen.
+type BreakerChange struct {
+	Instance string
+	Layer    string
+	From     string
+	To       string
+}
+
+// Retry is emitted before an operation on a Redis layer is retried after
+// the transient error Err. Attempt counts from 2.
+type Retry struct {
+	Instance string
+	Layer    string
+	Op       string
+	Attempt  int
+	Err      error
+}
+
+// Hedge is emitted after a read of a guardian layer was sent to a second
+// node because the first was slow. Won is set if the second node answered
+// first.
+type Hedge struct {
+	Instance string
+	Layer    string
+	Won      bool
+}
+
+// Oversize is emitted when a value of Bytes, as stored, exceeds the
+// max-value-size Limit of a layer, or when an entry exceeds the whole
+// max-bytes Limit of a tiny layer. Rejected is set if Set failed because of
+// it, otherwise the layer was skipped.
+type Oversize struct {
+	Instance string
+	Layer    string
+	Bytes    int
+	Limit    int64
+	Rejected bool
+}
+
+// Corrupt is emitted when a value read from a layer fails its checksum or
+// has a format this version cannot read. The read falls through to the next
+// layer like a miss.
+type Corrupt struct {
+	Instance string
+	Layer    string
+	Err      error
+}
+
+// MemorySample carries the cumulative bigcache statistics of a memory layer.
+// It is emitted when the statistics are sampled: by Stats and, for observers
+// such as PrometheusMetrics which collect samples when they are read, on
+// every read.
+type MemorySample struct {
+	Instance string
+	Layer    string
+	Stats    MemoryStats
+}
+
+func (Hit) event()           {}
+func (Miss) event()          {}
+func (Hotness) event()       {}
+func (GetDone) event()       {}
+func (SetDone) event()       {}
+func (OpDone) event()        {}
+func (Fill) event()          {}
+func (Evict) event()         {}
+func (Amnesia) event()       {}
+func (BreakerChange) event() {}
+func (Retry) event()         {}
+func (Hedge) event()         {}
+func (Oversize) event()      {}
+func (Corrupt) event()       {}
+func (MemorySample) event()  {}
+
+// sampledObserver is implemented by observers which ask for samples of
+// statistics when they are read. The returned func removes the sampler.
+type sampledObserver interface {
+	addSampler(sample func()) (remove func())
+}
+
+// multiObserver forwards events to several observers
+type multiObserver []Observer
+
+func (mo multiObserver) Observe(event Event) {
+	for _, o := range mo {
+		o.Observe(event)
+	}
+}
+
+func combineObservers(observers ...Observer) Observer {
+	var nonNil multiObserver
+	for _, o := range observers {
+		if o != nil {
+			nonNil = append(nonNil, o)
+		}
+	}
+	if len(nonNil) == 1 {
+		return nonNil[0]
+	}
+	return nonNil
+}
+
+// legacyObserver translates events into the positional labels historically
+// passed to ITimer and ICounter
+type legacyObserver struct {
+	timer   ITimer
+	counter ICounter
+}
+
+// NewLegacyObserver returns an Observer which reports events to timer and
+// counter with positional labels: hits as (instance, layer), misses as
+// (instance, "miss"), hotness as (instance-hotness, level), evictions as
+// (layer-eviction, reason) and operation latencies as (layer, op, result).
+// Nil arguments are replaced by dummies.
+func NewLegacyObserver(timer ITimer, counter ICounter) Observer {
+	if timer == nil {
+		timer = NewDummyTimer()
+	}
+	if counter == nil {
+		counter = NewDummyCounter()
+	}
+	return &legacyObserver{timer: timer, counter: counter}
+}
+
+func (lo *legacyObserver) Observe(event Event) {
+	switch e := event.(type) {
+	case Hit:
+		lo.counter.Inc(e.Instance, e.Layer)
+	case Miss:
+		lo.counter.Inc(e.Instance, "miss")
+	case Hotness:
+		lo.counter.Inc(e.Instance+"-hotness", e.Level)
+	case Evict:
+		lo.counter.Inc(e.Layer+"-eviction", e.Reason)
+	case GetDone:
+		lo.timer.Done(time.Now().Add(-e.Duration), e.Layer, "get", e.Result)
+	case SetDone:
+		lo.timer.Done(time.Now().Add(-e.Duration), e.Layer, "set", resultLabel(e.Err))
+	case OpDone:
+		lo.timer.Done(time.Now().Add(-e.Duration), e.Layer, e.Op, e.Result)
+	}
+}
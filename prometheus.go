@@ -0,0 +1,308 @@
+package mnemosyne
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the histogram buckets, in seconds, used for
+// operation latencies unless others are given
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// PrometheusMetrics is an Observer which aggregates cache hits, misses, data
+// hotness, back-fills, evictions, amnesia, oversized values, written bytes
+// and operation latencies in memory and serves them in the Prometheus text
+// format. It also implements ICounter and ITimer for use with the positional
+// labels.
+type PrometheusMetrics struct {
+	buckets []float64
+
+	mu       sync.Mutex
+	families map[string]*metricFamily
+
+	// samplersMu is held while sampling, so a removed sampler is not
+	// running anymore
+	samplersMu  sync.Mutex
+	samplers    map[uint64]func()
+	nextSampler uint64
+}
+
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	series     map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// histogram only
+	bucketCounts []uint64
+	count        uint64
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics using the given latency
+// buckets in seconds, or DefaultLatencyBuckets when none are given
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &PrometheusMetrics{
+		buckets:  buckets,
+		families: make(map[string]*metricFamily),
+		samplers: make(map[uint64]func()),
+	}
+}
+
+// Inc implements ICounter, interpreting the labels used by Mnemosyne
+func (pm *PrometheusMetrics) Inc(labels ...string) {
+	if len(labels) != 2 {
+		pm.add("mnemosyne_events_total", "Cache events which are not otherwise classified.", []string{"event"}, []string{strings.Join(labels, "/")}, 1)
+		return
+	}
+	name, value := labels[0], labels[1]
+	switch {
+	case strings.HasSuffix(name, "-hotness"):
+		pm.add("mnemosyne_hotness_total", "Reads by age of the data relative to soft-ttl.", []string{"instance", "hotness"}, []string{strings.TrimSuffix(name, "-hotness"), value}, 1)
+	case strings.HasSuffix(name, "-eviction"):
+		// the positional labels do not carry the instance
+		pm.add("mnemosyne_evictions_total", "Entries removed from in-process layers.", []string{"instance", "layer", "reason"}, []string{"", strings.TrimSuffix(name, "-eviction"), value}, 1)
+	case value == "miss":
+		pm.add("mnemosyne_misses_total", "Reads which missed every layer.", []string{"instance"}, []string{name}, 1)
+	default:
+		pm.add("mnemosyne_hits_total", "Reads served by a layer.", []string{"instance", "layer"}, []string{name, value}, 1)
+	}
+}
+
+// Observe implements Observer
+func (pm *PrometheusMetrics) Observe(event Event) {
+	switch e := event.(type) {
+	case Hit:
+		pm.add("mnemosyne_hits_total", "Reads served by a layer.", []string{"instance", "layer"}, []string{e.Instance, e.Layer}, 1)
+	case Miss:
+		pm.add("mnemosyne_misses_total", "Reads which missed every layer.", []string{"instance"}, []string{e.Instance}, 1)
+	case Hotness:
+		pm.add("mnemosyne_hotness_total", "Reads by age of the data relative to soft-ttl.", []string{"instance", "hotness"}, []string{e.Instance, e.Level}, 1)
+	case Evict:
+		pm.add("mnemosyne_evictions_total", "Entries removed from in-process layers.", []string{"instance", "layer", "reason"}, []string{e.Instance, e.Layer, e.Reason}, 1)
+	case Amnesia:
+		pm.add("mnemosyne_amnesia_total", "Layer reads skipped because of amnesia.", []string{"instance", "layer"}, []string{e.Instance, e.Layer}, 1)
+	case BreakerChange:
+		pm.add("mnemosyne_breaker_transitions_total", "Circuit breaker state changes of Redis layers.", []string{"instance", "layer", "state"}, []string{e.Instance, e.Layer, e.To}, 1)
+	case Retry:
+		pm.add("mnemosyne_retries_total", "Operations on Redis layers retried after transient errors.", []string{"instance", "layer", "operation"}, []string{e.Instance, e.Layer, e.Op}, 1)
+	case Hedge:
+		winner := "primary"
+		if e.Won {
+			winner = "hedge"
+		}
+		pm.add("mnemosyne_hedges_total", "Reads of guardian layers sent to a second node.", []string{"instance", "layer", "winner"}, []string{e.Instance, e.Layer, winner}, 1)
+	case Oversize:
+		pm.add("mnemosyne_oversized_values_total", "Values which exceeded the max-value-size of a layer.", []string{"instance", "layer"}, []string{e.Instance, e.Layer}, 1)
+	case Corrupt:
+		pm.add("mnemosyne_corrupt_values_total", "Values which could not be decoded, because they were corrupt or of an unknown format.", []string{"instance", "layer"}, []string{e.Instance, e.Layer}, 1)
+	case MemorySample:
+		labels := []string{e.Instance, e.Layer}
+		pm.set("mnemosyne_memory_hits_total", "Reads of memory layers found by bigcache.", []string{"instance", "layer"}, labels, float64(e.Stats.Hits))
+		pm.set("mnemosyne_memory_misses_total", "Reads of memory layers not found by bigcache.", []string{"instance", "layer"}, labels, float64(e.Stats.Misses))
+		pm.set("mnemosyne_memory_collisions_total", "Key hash collisions in memory layers.", []string{"instance", "layer"}, labels, float64(e.Stats.Collisions))
+	case Fill:
+		pm.add("mnemosyne_fills_total", "Upper layers back-filled from a lower layer.", []string{"instance", "layer", "result"}, []string{e.Instance, e.Layer, resultLabel(e.Err)}, 1)
+	case GetDone:
+		pm.observe("mnemosyne_operation_duration_seconds", "Latency of layer operations.", []string{"instance", "layer", "operation", "result"}, []string{e.Instance, e.Layer, "get", e.Result}, e.Duration.Seconds())
+	case OpDone:
+		pm.observe("mnemosyne_operation_duration_seconds", "Latency of layer operations.", []string{"instance", "layer", "operation", "result"}, []string{e.Instance, e.Layer, e.Op, e.Result}, e.Duration.Seconds())
+	case SetDone:
+		pm.observe("mnemosyne_operation_duration_seconds", "Latency of layer operations.", []string{"instance", "layer", "operation", "result"}, []string{e.Instance, e.Layer, "set", resultLabel(e.Err)}, e.Duration.Seconds())
+		if e.Err == nil {
+			pm.add("mnemosyne_written_bytes_total", "Bytes written to a layer, after compression.", []string{"instance", "layer"}, []string{e.Instance, e.Layer}, float64(e.Bytes))
+		}
+	}
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// Start implements ITimer
+func (pm *PrometheusMetrics) Start() time.Time {
+	return time.Now()
+}
+
+// Done implements ITimer, expecting the layer, operation and result as labels
+func (pm *PrometheusMetrics) Done(start time.Time, labels ...string) {
+	// the positional labels do not carry the instance
+	values := make([]string, 4)
+	copy(values[1:], labels)
+	pm.observe("mnemosyne_operation_duration_seconds", "Latency of layer operations.", []string{"instance", "layer", "operation", "result"}, values, time.Since(start).Seconds())
+}
+
+func (pm *PrometheusMetrics) family(name, help, kind string, labelNames []string) *metricFamily {
+	f, ok := pm.families[name]
+	if !ok {
+		f = &metricFamily{
+			name:       name,
+			help:       help,
+			kind:       kind,
+			labelNames: labelNames,
+			series:     make(map[string]*metricSeries),
+		}
+		pm.families[name] = f
+	}
+	return f
+}
+
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (pm *PrometheusMetrics) add(name, help string, labelNames, labelValues []string, delta float64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.family(name, help, "counter", labelNames).get(labelValues).value += delta
+}
+
+// set replaces the value of a counter which is sampled rather than counted
+func (pm *PrometheusMetrics) set(name, help string, labelNames, labelValues []string, value float64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.family(name, help, "counter", labelNames).get(labelValues).value = value
+}
+
+func (pm *PrometheusMetrics) addSampler(sample func()) (remove func()) {
+	pm.samplersMu.Lock()
+	defer pm.samplersMu.Unlock()
+	id := pm.nextSampler
+	pm.nextSampler++
+	pm.samplers[id] = sample
+	return func() {
+		pm.samplersMu.Lock()
+		defer pm.samplersMu.Unlock()
+		delete(pm.samplers, id)
+	}
+}
+
+func (pm *PrometheusMetrics) observe(name, help string, labelNames, labelValues []string, value float64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	s := pm.family(name, help, "histogram", labelNames).get(labelValues)
+	if s.bucketCounts == nil {
+		s.bucketCounts = make([]uint64, len(pm.buckets))
+	}
+	for i, bound := range pm.buckets {
+		if value <= bound {
+			s.bucketCounts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// ServeHTTP serves the collected metrics in the Prometheus text format
+func (pm *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = pm.WriteText(w)
+}
+
+// WriteText writes the collected metrics in the Prometheus text format,
+// sampling the statistics of memory layers first
+func (pm *PrometheusMetrics) WriteText(w io.Writer) error {
+	// samples are observed, which takes pm.mu
+	pm.samplersMu.Lock()
+	for _, sample := range pm.samplers {
+		sample()
+	}
+	pm.samplersMu.Unlock()
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	names := make([]string, 0, len(pm.families))
+	for name := range pm.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := pm.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			labels := formatLabels(f.labelNames, s.labelValues)
+			if f.kind != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, labels, formatFloat(s.value))
+				continue
+			}
+			for i, bound := range pm.buckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(labels, "le", formatFloat(bound)), s.bucketCounts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, labels, formatFloat(s.value))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, labels, s.count)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + quoteLabel(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(labels, name, value string) string {
+	pair := name + "=" + quoteLabel(value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
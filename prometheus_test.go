@@ -0,0 +1,21 @@
+package mnemosyne
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusRemovedSamplerIsNotCalled(t *testing.T) {
+	pm := NewPrometheusMetrics()
+	var kept, removed int
+	pm.addSampler(func() { kept++ })
+	remove := pm.addSampler(func() { removed++ })
+
+	assert.NoError(t, pm.WriteText(io.Discard))
+	remove()
+	assert.NoError(t, pm.WriteText(io.Discard))
+	assert.Equal(t, 2, kept)
+	assert.Equal(t, 1, removed, "a closed instance should not be sampled")
+}
@@ -0,0 +1,47 @@
+package mnemosyne
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const defaultRefreshBeta = 1.0
+
+// earlyRefresh implements probabilistic early expiration (XFetch): a value
+// which took delta to compute is reported as due for an update at
+// now - delta*beta*ln(rand) >= cached time + soft-ttl, so callers start
+// refreshing a hot key at different moments before soft-ttl instead of all
+// at once when it passes.
+type earlyRefresh struct {
+	enabled bool
+	beta    float64
+}
+
+func newEarlyRefresh(enabled bool, beta float64) (earlyRefresh, error) {
+	if beta <= 0 || math.IsInf(beta, 0) || math.IsNaN(beta) {
+		return earlyRefresh{}, fmt.Errorf("%w: beta must be a positive number, got %v", ErrInvalidConfig, beta)
+	}
+	return earlyRefresh{enabled: enabled, beta: beta}, nil
+}
+
+// shouldUpdate reports whether value is due for an update
+func (mn *MnemosyneInstance) shouldUpdate(value *cachableRet) bool {
+	age := time.Since(value.Time)
+	if !mn.refresh.enabled || value.Delta <= 0 {
+		return age > mn.softTTL
+	}
+	// 1-rand.Float64() is in (0, 1], so the logarithm is finite
+	gap := time.Duration(float64(value.Delta) * mn.refresh.beta * -math.Log(1-rand.Float64()))
+	return age+gap >= mn.softTTL
+}
+
+// SetWithCost sets the value for a key like Set and records cost, the time
+// it took to compute value. With early-refresh enabled, values which are
+// costly to compute are reported as due for an update earlier before their
+// soft-ttl.
+func (mn *MnemosyneInstance) SetWithCost(ctx context.Context, key string, value interface{}, cost time.Duration) error {
+	return mn.set(ctx, key, value, cost)
+}
@@ -0,0 +1,127 @@
+package mnemosyne
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultRetryBackoff    = 10 * time.Millisecond
+	defaultRetryMaxBackoff = time.Second
+)
+
+// retryPolicy retries failed calls to a Redis layer with exponential backoff
+// and full jitter
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// newRetryPolicy reads the retry policy of a layer from config and returns
+// nil if calls should not be retried
+func newRetryPolicy(config *viper.Viper, keyPrefix string) (*retryPolicy, error) {
+	attempts := config.GetInt(keyPrefix + ".retry-attempts")
+	backoff := defaultRetryBackoff
+	if config.IsSet(keyPrefix + ".retry-backoff") {
+		backoff = config.GetDuration(keyPrefix + ".retry-backoff")
+	}
+	maxBackoff := defaultRetryMaxBackoff
+	if config.IsSet(keyPrefix + ".retry-max-backoff") {
+		maxBackoff = config.GetDuration(keyPrefix + ".retry-max-backoff")
+	}
+
+	switch {
+	case attempts < 0:
+		return nil, fmt.Errorf("%w: retry-attempts must not be negative, got %d", ErrInvalidConfig, attempts)
+	case backoff <= 0:
+		return nil, fmt.Errorf("%w: retry-backoff must be positive, got %v", ErrInvalidConfig, backoff)
+	case maxBackoff < backoff:
+		return nil, fmt.Errorf("%w: retry-max-backoff must not be below retry-backoff, got %v", ErrInvalidConfig, maxBackoff)
+	}
+	if attempts <= 1 {
+		return nil, nil
+	}
+	return &retryPolicy{attempts: attempts, backoff: backoff, maxBackoff: maxBackoff}, nil
+}
+
+// delay returns the jittered backoff before the given retry, counted from 1
+func (rp *retryPolicy) delay(retry int) time.Duration {
+	ceiling := rp.backoff << min(retry-1, 30)
+	if ceiling <= 0 || ceiling > rp.maxBackoff {
+		ceiling = rp.maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
+
+// retriable reports whether err is a transient failure worth retrying:
+// network errors and the Redis errors returned while a server is loading,
+// failing over or resharding. Timeouts are not retried, a server which did
+// not answer in time would most likely not answer the retry either.
+func retriable(err error) bool {
+	if err == nil || errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	if netErr != nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	for _, prefix := range []string{"LOADING ", "READONLY ", "TRYAGAIN ", "CLUSTERDOWN ", "MASTERDOWN "} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redisCall runs an operation against the Redis server of the layer through
+// its circuit breaker, retrying transient failures as long as ctx allows.
+// The breaker records the outcome of the whole operation, not each attempt.
+func (cr *cache) redisCall(ctx context.Context, op string, call func() error) (err error) {
+	ticket, ok := cr.breaker.allow()
+	if !ok {
+		return ErrCircuitOpen
+	}
+	var took time.Duration
+	attempt := func() error {
+		startMarker := time.Now()
+		defer func() { took += time.Since(startMarker) }()
+		return call()
+	}
+	defer func() { cr.breaker.record(ticket, err, took) }()
+
+	err = attempt()
+	if cr.retry == nil {
+		return err
+	}
+	for retry := 1; retry < cr.retry.attempts && retriable(err); retry++ {
+		delay := cr.retry.delay(retry)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		cr.observer.Observe(Retry{Instance: cr.instanceName, Layer: cr.layerName, Op: op, Attempt: retry + 1, Err: err})
+		err = attempt()
+	}
+	return err
+}
@@ -0,0 +1,34 @@
+package mnemosyne
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetriable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: io.EOF, want: true},
+		{err: fmt.Errorf("read: %w", syscall.ECONNRESET), want: true},
+		{err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, want: true},
+		{err: &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, want: false},
+		{err: errors.New("LOADING Redis is loading the dataset in memory"), want: true},
+		{err: errors.New("ERR unknown command"), want: false},
+		{err: context.DeadlineExceeded, want: false},
+		{err: ErrCircuitOpen, want: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, retriable(tt.err), "%v", tt.err)
+	}
+}
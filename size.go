@@ -0,0 +1,104 @@
+package mnemosyne
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// errTooLargeToFill is returned when a value read from a lower layer is too
+// large to be copied into the layer. It is not reported as an oversized
+// value or a back-fill, as nothing was written.
+var errTooLargeToFill = errors.New("value too large to fill layer")
+
+// sampledLogInterval is the minimum time between two logs of oversized or
+// corrupt values of the same layer
+const sampledLogInterval = 10 * time.Second
+
+// logSampler limits a log message to one per sampledLogInterval
+type logSampler struct {
+	lastLog    atomic.Int64
+	suppressed atomic.Int64
+}
+
+// sizeLimit keeps values above max bytes, as stored, out of a layer
+type sizeLimit struct {
+	max int64
+	// reject makes Set fail on oversized values instead of skipping the layer
+	reject bool
+
+	logSampler
+}
+
+// newSizeLimit reads the value size limit of a layer from config and returns
+// nil if values of any size are stored
+func newSizeLimit(config *viper.Viper, keyPrefix string) (*sizeLimit, error) {
+	limit := config.GetInt64(keyPrefix + ".max-value-size")
+	mode := config.GetString(keyPrefix + ".oversize")
+	switch {
+	case limit < 0:
+		return nil, fmt.Errorf("%w: max-value-size must not be negative, got %d", ErrInvalidConfig, limit)
+	case mode != "" && mode != "skip" && mode != "error":
+		return nil, fmt.Errorf("%w: oversize must be skip or error, got %q", ErrInvalidConfig, mode)
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	return &sizeLimit{max: limit, reject: mode == "error"}, nil
+}
+
+func (sl *sizeLimit) exceeds(size int) bool {
+	return sl != nil && int64(size) > sl.max
+}
+
+// shouldLog reports whether the message may be logged now, and how many were
+// not logged since the last time. A nil sampler logs every message.
+func (ls *logSampler) shouldLog(now time.Time) (bool, int64) {
+	if ls == nil {
+		return true, 0
+	}
+	last := ls.lastLog.Load()
+	if now.UnixNano()-last < int64(sampledLogInterval) || !ls.lastLog.CompareAndSwap(last, now.UnixNano()) {
+		ls.suppressed.Add(1)
+		return false, 0
+	}
+	return true, ls.suppressed.Swap(0)
+}
+
+// oversized handles a value of size bytes which is too large for the layer.
+// The key is deleted from the layer, so an older value is not served in
+// place of the new one, which only lives in the layers below.
+func (cr *cache) oversized(ctx context.Context, key string, size int) error {
+	cr.observer.Observe(Oversize{
+		Instance: cr.instanceName,
+		Layer:    cr.layerName,
+		Bytes:    size,
+		Limit:    cr.sizeLimit.max,
+		Rejected: cr.sizeLimit.reject,
+	})
+	deleteErr := cr.delete(ctx, key)
+	if outcome(deleteErr) != "error" {
+		deleteErr = nil
+	}
+	if ok, suppressed := cr.sizeLimit.shouldLog(time.Now()); ok || deleteErr != nil {
+		entry := logrus.WithField("cache", cr.instanceName).
+			WithField("layer", cr.layerName).
+			WithField("key_hash", keyHash(key)).
+			WithField("bytes", size).
+			WithField("limit", cr.sizeLimit.max).
+			WithField("suppressed", suppressed)
+		if deleteErr != nil {
+			entry = entry.WithError(deleteErr)
+		}
+		entry.Warn("value exceeds max-value-size of layer")
+	}
+	if cr.sizeLimit.reject {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrValueTooLarge, size, cr.sizeLimit.max)
+	}
+	return nil
+}
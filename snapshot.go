@@ -0,0 +1,244 @@
+package mnemosyne
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// snapshotMagic starts every snapshot, followed by the format version
+const (
+	snapshotMagic   = "MNEMOSNP"
+	snapshotVersion = 1
+)
+
+var errBadSnapshot = errors.New("invalid cache snapshot")
+
+// Snapshot writes the entries of the memory and tiny layers of the instance
+// to w, preserving their stored bytes, write times and expiry, so that they
+// can be brought back by Restore after a restart. Expired entries are
+// skipped.
+//
+// A snapshot is a sequence of records of uvarint length-prefixed layer name,
+// key and in-process entry, ended by an empty layer name.
+func (mn *MnemosyneInstance) Snapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(snapshotVersion); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var writeErr error
+	for _, layer := range mn.cacheLayers {
+		if layer.tiny == nil && layer.inMemCache == nil {
+			continue
+		}
+		layer.eachEntry(func(key string, entry memEntry) bool {
+			if entry.expired(now) {
+				return true
+			}
+			writeErr = writeSnapshotRecord(bw, layer.layerName, key, entry.encode())
+			return writeErr == nil
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	if err := writeSnapshotField(bw, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore loads entries written by Snapshot into the layers of the same
+// name, keeping their original expiry. Entries of layers the instance does
+// not have, which have expired meanwhile or which exceed the max-value-size
+// of their layer are dropped, as are entries the layer fails to store. It
+// returns the number of restored entries.
+func (mn *MnemosyneInstance) Restore(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, fmt.Errorf("%w: %v", errBadSnapshot, err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, fmt.Errorf("%w: bad magic", errBadSnapshot)
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", errBadSnapshot, header[len(snapshotMagic)])
+	}
+
+	layers := make(map[string]*cache)
+	for _, layer := range mn.cacheLayers {
+		if layer.tiny != nil || layer.inMemCache != nil {
+			layers[layer.layerName] = layer
+		}
+	}
+
+	now := time.Now()
+	restored := 0
+	for {
+		layerName, err := readSnapshotField(br)
+		if err != nil {
+			return restored, err
+		}
+		if len(layerName) == 0 {
+			return restored, nil
+		}
+		key, err := readSnapshotField(br)
+		if err != nil {
+			return restored, err
+		}
+		encoded, err := readSnapshotField(br)
+		if err != nil {
+			return restored, err
+		}
+		entry, err := decodeMemEntry(encoded)
+		if err != nil {
+			return restored, fmt.Errorf("%w: %v", errBadSnapshot, err)
+		}
+
+		layer, ok := layers[string(layerName)]
+		if !ok || entry.expired(now) || layer.sizeLimit.exceeds(len(entry.value)) {
+			continue
+		}
+		if layer.tiny != nil {
+			layer.tiny.store(string(key), &entry)
+		} else if err := layer.inMemCache.Set(string(key), encoded); err != nil {
+			// bigcache rejects entries larger than a shard, the rest of the
+			// snapshot is still worth restoring
+			logrus.WithError(err).WithField("cache", mn.name).WithField("layer", layer.layerName).
+				WithField("key_hash", keyHash(string(key))).
+				Warn("failed to restore entry from snapshot")
+			continue
+		}
+		restored++
+	}
+}
+
+// eachEntry calls fn for the entries of an in-process layer until it
+// returns false
+func (cr *cache) eachEntry(fn func(key string, entry memEntry) bool) {
+	if cr.tiny != nil {
+		cr.tiny.each(func(key string, entry *memEntry) bool {
+			return fn(key, *entry)
+		})
+		return
+	}
+	it := cr.inMemCache.Iterator()
+	for it.SetNext() {
+		info, err := it.Value()
+		if err != nil {
+			// the entry was removed while iterating
+			continue
+		}
+		entry, err := decodeMemEntry(info.Value())
+		if err != nil {
+			continue
+		}
+		if !fn(info.Key(), entry) {
+			return
+		}
+	}
+}
+
+func writeSnapshotRecord(w *bufio.Writer, layerName, key string, encoded []byte) error {
+	for _, field := range [][]byte{[]byte(layerName), []byte(key), encoded} {
+		if err := writeSnapshotField(w, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSnapshotField(w *bufio.Writer, field []byte) error {
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(field)))); err != nil {
+		return err
+	}
+	_, err := w.Write(field)
+	return err
+}
+
+func readSnapshotField(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadSnapshot, err)
+	}
+	if size > maxSnapshotField {
+		return nil, fmt.Errorf("%w: field of %d bytes", errBadSnapshot, size)
+	}
+	field := make([]byte, size)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadSnapshot, err)
+	}
+	return field, nil
+}
+
+// maxSnapshotField bounds allocations when reading a corrupt snapshot
+const maxSnapshotField = 1 << 30
+
+// snapshotToFile writes a snapshot of the instance to path, replacing it
+// atomically so a crash never leaves a truncated snapshot behind
+func (mn *MnemosyneInstance) snapshotToFile(path string) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := mn.Snapshot(tmp); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the entries of dir, so a rename into it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// restoreFromFile restores the snapshot at path, if there is one
+func (mn *MnemosyneInstance) restoreFromFile(path string) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("cache", mn.name).Error("failed to open cache snapshot")
+		return
+	}
+	defer f.Close()
+	restored, err := mn.Restore(f)
+	entry := logrus.WithField("cache", mn.name).WithField("restored", restored)
+	if err != nil {
+		entry.WithError(err).Error("failed to restore cache snapshot")
+		return
+	}
+	entry.Info("restored cache snapshot")
+}
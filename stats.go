@@ -0,0 +1,335 @@
+package mnemosyne
+
+import (
+	"expvar"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const latencySamples = 1024
+
+// InstanceStats is a snapshot of the statistics of a cache instance
+type InstanceStats struct {
+	Name string
+	// Hits and Misses count reads of the instance, HitRatio is Hits/(Hits+Misses)
+	Hits     int64
+	Misses   int64
+	HitRatio float64
+	Layers   []LayerStats
+}
+
+// LayerStats is a snapshot of the statistics of a single layer
+type LayerStats struct {
+	Name string
+	Type string
+	// Served is the number of instance reads answered by this layer
+	Served int64
+	// Hits, Misses and HitRatio describe the reads of this layer
+	Hits     int64
+	Misses   int64
+	HitRatio float64
+	// Errors counts failed operations of any kind
+	Errors int64
+	// Retries counts operations retried after transient errors
+	Retries int64
+	// Hedges counts reads sent to a second node, HedgesWon those it answered first
+	Hedges    int64
+	HedgesWon int64
+	// Amnesia counts reads which fell through because of amnesia
+	Amnesia int64
+	// Oversized counts values which exceeded the layer's max-value-size
+	Oversized int64
+	// Corrupt counts values which could not be decoded, reads of them fall
+	// through like misses but are not counted as such
+	Corrupt int64
+	// BackFills counts values copied into this layer from a lower layer
+	BackFills int64
+	Sets      int64
+	Evictions int64
+	// BytesWritten is the total size of values written, after compression
+	BytesWritten int64
+	// BytesStored is the size of the entries held by tiny and disk layers, 0
+	// for other layers
+	BytesStored int64
+	// BytesAllocated is the memory bigcache allocated for a memory layer,
+	// which grows with the entries but does not shrink when they are removed
+	BytesAllocated int64
+	// Breaker is the state of the layer's circuit breaker, empty if it has none
+	Breaker    string
+	GetLatency LatencyStats
+	SetLatency LatencyStats
+}
+
+// LatencyStats are percentiles over the most recent operations
+type LatencyStats struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// latencyWindow keeps the most recent latencies of an operation
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, 0, size)}
+}
+
+func (lw *latencyWindow) add(d time.Duration) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.samples) < cap(lw.samples) {
+		lw.samples = append(lw.samples, d)
+		return
+	}
+	lw.samples[lw.next] = d
+	lw.next = (lw.next + 1) % len(lw.samples)
+}
+
+// percentile returns the p-th percentile (0-100) of the recorded latencies,
+// or false if none were recorded
+func (lw *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	sorted := lw.sorted()
+	if len(sorted) == 0 {
+		return 0, false
+	}
+	return pick(sorted, p), true
+}
+
+func (lw *latencyWindow) sorted() []time.Duration {
+	lw.mu.Lock()
+	sorted := slices.Clone(lw.samples)
+	lw.mu.Unlock()
+	slices.Sort(sorted)
+	return sorted
+}
+
+func pick(sorted []time.Duration, p float64) time.Duration {
+	idx := int(p / 100 * float64(len(sorted)-1))
+	return sorted[min(max(idx, 0), len(sorted)-1)]
+}
+
+func (lw *latencyWindow) stats() LatencyStats {
+	sorted := lw.sorted()
+	if len(sorted) == 0 {
+		return LatencyStats{}
+	}
+	return LatencyStats{
+		P50: pick(sorted, 50),
+		P90: pick(sorted, 90),
+		P99: pick(sorted, 99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+type layerCounters struct {
+	served       atomic.Int64
+	hits         atomic.Int64
+	misses       atomic.Int64
+	errors       atomic.Int64
+	retries      atomic.Int64
+	hedges       atomic.Int64
+	hedgesWon    atomic.Int64
+	amnesia      atomic.Int64
+	oversized    atomic.Int64
+	corrupt      atomic.Int64
+	backFills    atomic.Int64
+	sets         atomic.Int64
+	evictions    atomic.Int64
+	bytesWritten atomic.Int64
+	getLatency   *latencyWindow
+	setLatency   *latencyWindow
+}
+
+// statsCollector is the Observer which aggregates the statistics of an instance
+type statsCollector struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+	layers map[string]*layerCounters
+}
+
+func newStatsCollector(layerNames []string) *statsCollector {
+	sc := &statsCollector{layers: make(map[string]*layerCounters, len(layerNames))}
+	for _, name := range layerNames {
+		sc.layers[name] = &layerCounters{
+			getLatency: newLatencyWindow(latencySamples),
+			setLatency: newLatencyWindow(latencySamples),
+		}
+	}
+	return sc
+}
+
+func (sc *statsCollector) Observe(event Event) {
+	switch e := event.(type) {
+	case Hit:
+		sc.hits.Add(1)
+		if lc, ok := sc.layers[e.Layer]; ok {
+			lc.served.Add(1)
+		}
+	case Miss:
+		sc.misses.Add(1)
+	case GetDone:
+		if lc, ok := sc.layers[e.Layer]; ok {
+			switch e.Result {
+			case "ok":
+				lc.hits.Add(1)
+			case "miss", "corrupt":
+				// corrupt values are read like misses and counted by
+				// the Corrupt event, they do not mean the layer failed
+				lc.misses.Add(1)
+			default:
+				lc.errors.Add(1)
+			}
+			lc.getLatency.add(e.Duration)
+		}
+	case SetDone:
+		if lc, ok := sc.layers[e.Layer]; ok {
+			lc.sets.Add(1)
+			if e.Err != nil {
+				lc.errors.Add(1)
+			} else {
+				lc.bytesWritten.Add(int64(e.Bytes))
+			}
+			lc.setLatency.add(e.Duration)
+		}
+	case OpDone:
+		if lc, ok := sc.layers[e.Layer]; ok && e.Result == "error" {
+			lc.errors.Add(1)
+		}
+	case Fill:
+		if lc, ok := sc.layers[e.Layer]; ok && e.Err == nil {
+			lc.backFills.Add(1)
+		}
+	case Retry:
+		if lc, ok := sc.layers[e.Layer]; ok {
+			lc.retries.Add(1)
+		}
+	case Hedge:
+		if lc, ok := sc.layers[e.Layer]; ok {
+			lc.hedges.Add(1)
+			if e.Won {
+				lc.hedgesWon.Add(1)
+			}
+		}
+	case Amnesia:
+		if lc, ok := sc.layers[e.Layer]; ok {
+			lc.amnesia.Add(1)
+		}
+	case Evict:
+		if lc, ok := sc.layers[e.Layer]; ok {
+			lc.evictions.Add(1)
+		}
+	case Oversize:
+		if lc, ok := sc.layers[e.Layer]; ok {
+			lc.oversized.Add(1)
+		}
+	case Corrupt:
+		if lc, ok := sc.layers[e.Layer]; ok {
+			lc.corrupt.Add(1)
+		}
+	}
+}
+
+func ratio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// Stats returns a snapshot of the statistics of the instance. It also emits
+// a MemorySample for each memory layer.
+func (mn *MnemosyneInstance) Stats() InstanceStats {
+	mn.sampleMemory()
+	hits, misses := mn.stats.hits.Load(), mn.stats.misses.Load()
+	stats := InstanceStats{
+		Name:     mn.name,
+		Hits:     hits,
+		Misses:   misses,
+		HitRatio: ratio(hits, misses),
+		Layers:   make([]LayerStats, 0, len(mn.cacheLayers)),
+	}
+	for _, layer := range mn.cacheLayers {
+		lc := mn.stats.layers[layer.layerName]
+		layerHits, layerMisses := lc.hits.Load(), lc.misses.Load()
+		stats.Layers = append(stats.Layers, LayerStats{
+			Name:           layer.layerName,
+			Type:           layer.kind(),
+			Served:         lc.served.Load(),
+			Hits:           layerHits,
+			Misses:         layerMisses,
+			HitRatio:       ratio(layerHits, layerMisses),
+			Errors:         lc.errors.Load(),
+			Retries:        lc.retries.Load(),
+			Hedges:         lc.hedges.Load(),
+			HedgesWon:      lc.hedgesWon.Load(),
+			Amnesia:        lc.amnesia.Load(),
+			Oversized:      lc.oversized.Load(),
+			Corrupt:        lc.corrupt.Load(),
+			BackFills:      lc.backFills.Load(),
+			Sets:           lc.sets.Load(),
+			Evictions:      lc.evictions.Load(),
+			BytesWritten:   lc.bytesWritten.Load(),
+			BytesStored:    layer.bytesStored(),
+			BytesAllocated: layer.bytesAllocated(),
+			Breaker:        layer.breaker.currentState(),
+			GetLatency:     lc.getLatency.stats(),
+			SetLatency:     lc.setLatency.stats(),
+		})
+	}
+	return stats
+}
+
+// Stats returns a snapshot of the statistics of every cache instance by name
+func (m *Mnemosyne) Stats() map[string]InstanceStats {
+	stats := make(map[string]InstanceStats, len(m.instances))
+	for name, instance := range m.instances {
+		stats[name] = instance.Stats()
+	}
+	return stats
+}
+
+// expvarMu serialises PublishExpvar, so two calls cannot both find a name
+// free and then publish it twice
+var expvarMu sync.Mutex
+
+// PublishExpvar publishes the statistics of all instances as the expvar
+// variable name, so they are served by the /debug/vars handler. Other code
+// publishing the same name concurrently is not guarded against, expvar
+// panics in that case.
+func (m *Mnemosyne) PublishExpvar(name string) error {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %q is already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() any {
+		return m.Stats()
+	}))
+	return nil
+}
+
+func (cr *cache) bytesStored() int64 {
+	switch {
+	case cr.disk != nil:
+		return cr.disk.size()
+	case cr.tiny != nil:
+		return cr.tiny.size()
+	default:
+		return 0
+	}
+}
+
+func (cr *cache) bytesAllocated() int64 {
+	if cr.inMemCache == nil {
+		return 0
+	}
+	return int64(cr.inMemCache.Capacity())
+}
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cafebazaar/mnemosyne"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandler(t *testing.T) {
+	config := setupTestConfig(t)
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+	cacheInstance := mnemosyneManager.Select("result")
+	assert.NoError(t, cacheInstance.Set(context.Background(), "users/42", TestType{Name: "admin"}))
+
+	handler := mnemosyne.NewAdminHandler(mnemosyneManager, mnemosyne.AdminOptions{
+		Authorize: func(r *http.Request) error {
+			if r.Header.Get("X-Admin") != "yes" {
+				return errors.New("not an admin")
+			}
+			return nil
+		},
+		AllowWrites: true,
+	})
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-Admin", "yes")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/instances", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = serve(http.MethodGet, "/instances/result/keys/users/42")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var inspected struct {
+		Layers []struct {
+			Layer   string
+			Present bool
+			Value   TestType
+		}
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &inspected))
+	assert.Len(t, inspected.Layers, 2)
+	for _, layer := range inspected.Layers {
+		assert.True(t, layer.Present, "key missing in %s", layer.Layer)
+		assert.Equal(t, "admin", layer.Value.Name)
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/instances/result/keys/users/42").Code)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodPost, "/instances/result/layers/user-memory/flush").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/instances/result/layers/nope/flush").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/instances/nope/stats").Code)
+
+	var cached TestType
+	assert.ErrorIs(t, cacheInstance.Get(context.Background(), "users/42", &cached), mnemosyne.ErrNotFound)
+}
+
+func TestAdminHandlerReadOnly(t *testing.T) {
+	redisServer := testRedisServer(t)
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", redisServer.Addr())
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+	cacheInstance := mnemosyneManager.Select("result")
+	assert.NoError(t, cacheInstance.Set(context.Background(), "kept", TestType{Name: "kept"}))
+
+	handler := mnemosyne.NewAdminHandler(mnemosyneManager, mnemosyne.AdminOptions{})
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodDelete, "/instances/result/keys/kept").Code)
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, "/instances/result/layers/user-memory/flush").Code)
+	var cached TestType
+	assert.NoError(t, cacheInstance.Get(context.Background(), "kept", &cached))
+
+	redisServer.Close()
+	rec := serve(http.MethodGet, "/instances/result/keys/missing")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var inspected struct {
+		Layers []struct {
+			Layer   string
+			Present bool
+			Error   string
+		}
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &inspected))
+	assert.Empty(t, inspected.Layers[0].Error, "a missing key is not an error")
+	assert.NotEmpty(t, inspected.Layers[1].Error, "a failing layer should not look like a miss")
+}
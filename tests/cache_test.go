@@ -1,7 +1,16 @@
 package tests
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,13 +37,38 @@ func testRedisServer(t *testing.T) *miniredis.Miniredis {
 
 // setupTestCache creates a new mnemosyne cache instance for testing
 func setupTestCache(t *testing.T) *mnemosyne.MnemosyneInstance {
+	t.Helper()
+	return newTestManager(t, setupTestConfig(t), nil, nil).Select("result")
+}
+
+// setupTestConfig returns the test configuration with the result instance
+// pointed at a fresh miniredis server
+func setupTestConfig(t *testing.T) *viper.Viper {
 	t.Helper()
 	config := newTestConfig()
-	mr := testRedisServer(t)
-	config.Set("cache.result.user-redis.address", mr.Addr())
+	config.Set("cache.result.user-redis.address", testRedisServer(t).Addr())
+	return config
+}
 
-	mnemosyneManager := mnemosyne.NewMnemosyne(config, nil, nil)
-	return mnemosyneManager.Select("result")
+// newTestManager creates a mnemosyne manager like NewMnemosyne and closes it
+// when the test ends, so its janitors, discovery and clients do not outlive
+// the test
+func newTestManager(t *testing.T, config *viper.Viper, commTimer mnemosyne.ITimer, cacheHitCounter mnemosyne.ICounter, opts ...mnemosyne.Option) *mnemosyne.Mnemosyne {
+	t.Helper()
+	manager := mnemosyne.NewMnemosyne(config, commTimer, cacheHitCounter, opts...)
+	t.Cleanup(func() { _ = manager.Close() })
+	return manager
+}
+
+// addTinyInstance adds the instance name to config, with a soft-ttl of an
+// hour and a single tiny layer named name-layer with the settings in layer
+func addTinyInstance(config *viper.Viper, name string, layer map[string]interface{}) {
+	config.Set("cache."+name+".soft-ttl", "1h")
+	config.Set("cache."+name+".layers", []string{name + "-layer"})
+	config.Set("cache."+name+"."+name+"-layer.type", "tiny")
+	for key, value := range layer {
+		config.Set("cache."+name+"."+name+"-layer."+key, value)
+	}
 }
 
 // newTestConfig creates a new Viper configuration for testing
@@ -70,3 +104,805 @@ func TestGetAndShouldUpdate(t *testing.T) {
 	assert.Equal(t, testCache, cachedData, "Cached data does not match original")
 	assert.False(t, shouldUpdate, "Should not update immediately after setting")
 }
+
+func TestInProcessLayersTTL(t *testing.T) {
+	config := setupTestConfig(t)
+	addTinyInstance(config, "tiny", map[string]interface{}{"ttl": "100ms"})
+
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+	ctx := context.Background()
+
+	result := mnemosyneManager.Select("result")
+	assert.NoError(t, result.Set(ctx, "ttl_item", TestType{Name: "memory"}))
+	layer, ttl := result.TTL("ttl_item")
+	assert.Equal(t, 0, layer, "memory layer should report the TTL")
+	assert.InDelta(t, (2 * time.Hour).Seconds(), ttl.Seconds(), 1)
+
+	tiny := mnemosyneManager.Select("tiny")
+	assert.NoError(t, tiny.Set(ctx, "ttl_item", TestType{Name: "tiny"}))
+	layer, ttl = tiny.TTL("ttl_item")
+	assert.Equal(t, 0, layer)
+	assert.True(t, ttl > 0 && ttl <= 100*time.Millisecond, "unexpected tiny TTL %v", ttl)
+
+	time.Sleep(150 * time.Millisecond)
+	var cached TestType
+	assert.ErrorIs(t, tiny.Get(ctx, "ttl_item", &cached), mnemosyne.ErrNotFound)
+}
+
+// recordingCounter counts the label sets passed to Inc
+type recordingCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newRecordingCounter() *recordingCounter {
+	return &recordingCounter{counts: make(map[string]int)}
+}
+
+func (c *recordingCounter) Inc(labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[strings.Join(labels, "/")]++
+}
+
+func (c *recordingCounter) count(labels ...string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[strings.Join(labels, "/")]
+}
+
+func TestBoundedTinyLayer(t *testing.T) {
+	for _, policy := range []string{"lru", "lfu", "tinylfu"} {
+		t.Run(policy, func(t *testing.T) {
+			config := setupTestConfig(t)
+			addTinyInstance(config, "tiny", map[string]interface{}{"max-entries": 10, "eviction": policy})
+
+			counter := newRecordingCounter()
+			tiny := newTestManager(t, config, nil, counter).Select("tiny")
+			ctx := context.Background()
+
+			var cached TestType
+			for i := 0; i < 100; i++ {
+				assert.NoError(t, tiny.Set(ctx, "hot", TestType{Name: "hot"}))
+				assert.NoError(t, tiny.Get(ctx, "hot", &cached))
+				assert.NoError(t, tiny.Set(ctx, fmt.Sprintf("cold_%d", i), TestType{Name: "cold"}))
+			}
+
+			present := 0
+			for i := 0; i < 100; i++ {
+				if tiny.Get(ctx, fmt.Sprintf("cold_%d", i), &cached) == nil {
+					present++
+				}
+			}
+			assert.LessOrEqual(t, present, 10, "layer holds more entries than max-entries")
+			assert.Equal(t, 91, counter.count("tiny-layer-eviction", "capacity"))
+			assert.NoError(t, tiny.Get(ctx, "hot", &cached), "frequently used key was evicted")
+		})
+	}
+
+	config := setupTestConfig(t)
+	addTinyInstance(config, "tiny", map[string]interface{}{"max-bytes": 64})
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+	tiny := mnemosyneManager.Select("tiny")
+	ctx := context.Background()
+	assert.NoError(t, tiny.Set(ctx, "huge", TestType{Name: strings.Repeat("x", 100)}))
+	layer := tiny.Stats().Layers[0]
+	assert.Zero(t, layer.Evictions, "an entry which never fits is not an eviction")
+	assert.Equal(t, int64(1), layer.Oversized)
+}
+
+func TestAmnesiaModes(t *testing.T) {
+	config := setupTestConfig(t)
+	addTinyInstance(config, "tiny", map[string]interface{}{"amnesia": 50, "amnesia-mode": "deterministic", "amnesia-window": "24h"})
+	addTinyInstance(config, "aged", map[string]interface{}{"amnesia": 100, "amnesia-mode": "age-weighted"})
+	addTinyInstance(config, "broken", map[string]interface{}{"amnesia-mode": "sometimes"})
+
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+	assert.Panics(t, func() { mnemosyneManager.Select("broken") }, "unknown amnesia-mode should be rejected")
+	assert.Panics(t, func() { mnemosyneManager.Select("aged") }, "age-weighted amnesia without ttl should be rejected")
+
+	tiny := mnemosyneManager.Select("tiny")
+	ctx := context.Background()
+	var cached TestType
+	// the windows themselves are tested against a pinned clock in amnesia_test.go
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("amnesia_%d", i)
+		assert.NoError(t, tiny.Set(ctx, key, TestType{Name: key}))
+		_ = tiny.Get(ctx, key, &cached)
+	}
+	assert.NotEqual(t, 0, tiny.Stats().Layers[0].Amnesia)
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	config := setupTestConfig(t)
+	for _, name := range []string{"early", "late"} {
+		addTinyInstance(config, name, nil)
+		config.Set("cache."+name+".soft-ttl", "1m")
+	}
+	config.Set("cache.early.early-refresh", true)
+	config.Set("cache.early.beta", 2)
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+	early, late := mnemosyneManager.Select("early"), mnemosyneManager.Select("late")
+
+	ctx := context.Background()
+	for _, instance := range []*mnemosyne.MnemosyneInstance{early, late} {
+		assert.NoError(t, instance.SetWithCost(ctx, "costly", TestType{Name: "costly"}, 1000*time.Hour))
+		assert.NoError(t, instance.Set(ctx, "cheap", TestType{Name: "cheap"}))
+	}
+
+	for i := 0; i < 20; i++ {
+		shouldUpdate, err := early.ShouldUpdate(ctx, "costly")
+		assert.NoError(t, err)
+		assert.True(t, shouldUpdate, "costly value should be refreshed early")
+
+		var cached TestType
+		shouldUpdate, err = early.GetAndShouldUpdate(ctx, "cheap", &cached)
+		assert.NoError(t, err)
+		assert.False(t, shouldUpdate, "value without cost should wait for soft-ttl")
+
+		shouldUpdate, err = late.ShouldUpdate(ctx, "costly")
+		assert.NoError(t, err)
+		assert.False(t, shouldUpdate, "early refresh is disabled")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	redisServer := testRedisServer(t)
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", redisServer.Addr())
+	config.Set("cache.guarded.soft-ttl", "1h")
+	config.Set("cache.guarded.layers", []string{"guarded-redis"})
+	config.Set("cache.guarded.guarded-redis.type", "redis")
+	config.Set("cache.guarded.guarded-redis.address", redisServer.Addr())
+	config.Set("cache.guarded.guarded-redis.breaker-error-rate", 0.5)
+	config.Set("cache.guarded.guarded-redis.breaker-window", 4)
+	config.Set("cache.guarded.guarded-redis.breaker-cooldown", "1s")
+
+	var mu sync.Mutex
+	var states []string
+	observer := mnemosyne.ObserverFunc(func(event mnemosyne.Event) {
+		if e, ok := event.(mnemosyne.BreakerChange); ok {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, e.To)
+		}
+	})
+	guarded := newTestManager(t, config, nil, nil, mnemosyne.WithObserver(observer)).Select("guarded")
+
+	ctx := context.Background()
+	var cached TestType
+	assert.NoError(t, guarded.Set(ctx, "guarded_item", TestType{Name: "guarded"}))
+	assert.Equal(t, mnemosyne.BreakerClosed, guarded.Stats().Layers[0].Breaker)
+
+	redisServer.Close()
+	for i := 0; i < 4; i++ {
+		assert.ErrorIs(t, guarded.Get(ctx, "guarded_item", &cached), mnemosyne.ErrNotFound)
+	}
+	assert.Equal(t, mnemosyne.BreakerOpen, guarded.Stats().Layers[0].Breaker)
+	assert.ErrorIs(t, guarded.Set(ctx, "guarded_item", TestType{Name: "guarded"}), mnemosyne.ErrCircuitOpen)
+
+	assert.NoError(t, redisServer.Restart())
+	// go-redis also backs off dialing for a second after repeated failures
+	time.Sleep(1200 * time.Millisecond)
+	assert.NoError(t, guarded.Set(ctx, "guarded_item", TestType{Name: "guarded"}))
+	assert.NoError(t, guarded.Get(ctx, "guarded_item", &cached))
+	assert.Equal(t, mnemosyne.BreakerClosed, guarded.Stats().Layers[0].Breaker)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{mnemosyne.BreakerOpen, mnemosyne.BreakerHalfOpen, mnemosyne.BreakerClosed}, states)
+}
+
+func TestRetries(t *testing.T) {
+	redisServer := testRedisServer(t)
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", redisServer.Addr())
+	config.Set("cache.retried.soft-ttl", "1h")
+	config.Set("cache.retried.layers", []string{"retried-redis"})
+	config.Set("cache.retried.retried-redis.type", "redis")
+	config.Set("cache.retried.retried-redis.address", redisServer.Addr())
+	config.Set("cache.retried.retried-redis.retry-attempts", 3)
+	config.Set("cache.retried.retried-redis.retry-backoff", "1ms")
+	config.Set("cache.retried.retried-redis.breaker-error-rate", 1)
+	config.Set("cache.retried.retried-redis.breaker-window", 4)
+	retried := newTestManager(t, config, nil, nil).Select("retried")
+	ctx := context.Background()
+
+	redisServer.SetError("LOADING Redis is loading the dataset in memory")
+	err := retried.Set(ctx, "retried_item", TestType{Name: "retried"})
+	assert.ErrorContains(t, err, "retried-redis: LOADING")
+	assert.Equal(t, int64(2), retried.Stats().Layers[0].Retries)
+	assert.Equal(t, mnemosyne.BreakerClosed, retried.Stats().Layers[0].Breaker, "retries should count as one call in the breaker")
+	assert.ErrorContains(t, retried.Flush("retried-redis"), "LOADING")
+	assert.Equal(t, int64(4), retried.Stats().Layers[0].Retries, "flush should be retried like the other operations")
+
+	redisServer.SetError("ERR something is broken")
+	assert.Error(t, retried.Delete(ctx, "retried_item"))
+	assert.Equal(t, int64(4), retried.Stats().Layers[0].Retries, "non-transient errors should not be retried")
+
+	redisServer.SetError("")
+	assert.NoError(t, retried.Set(ctx, "retried_item", TestType{Name: "retried"}))
+}
+
+// stuckRedisServer returns the address of a server which accepts connections
+// but never answers
+func stuckRedisServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		_ = listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// lossyRedisServer returns the address of a proxy to addr which loses the
+// reply to the first command containing marker by closing the connection
+func lossyRedisServer(t *testing.T, addr, marker string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	var lost atomic.Bool
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				_ = client.Close()
+				continue
+			}
+			var dropReply atomic.Bool
+			go func() {
+				defer server.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := client.Read(buf)
+					if err != nil {
+						return
+					}
+					if bytes.Contains(buf[:n], []byte(marker)) && lost.CompareAndSwap(false, true) {
+						dropReply.Store(true)
+					}
+					if _, err := server.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer client.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := server.Read(buf)
+					if err != nil || dropReply.Load() {
+						return
+					}
+					if _, err := client.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHedgedReads(t *testing.T) {
+	master := testRedisServer(t)
+	stuck := stuckRedisServer(t)
+
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", master.Addr())
+	config.Set("cache.hedged.soft-ttl", "1h")
+	config.Set("cache.hedged.layers", []string{"hedged-guardian"})
+	config.Set("cache.hedged.hedged-guardian.type", "guardian")
+	config.Set("cache.hedged.hedged-guardian.address", master.Addr())
+	config.Set("cache.hedged.hedged-guardian.slaves", []string{stuck})
+	config.Set("cache.hedged.hedged-guardian.read-timeout", "2s")
+	config.Set("cache.hedged.hedged-guardian.hedge-percentile", 90)
+	config.Set("cache.hedged.hedged-guardian.hedge-delay", "5ms")
+	hedged := newTestManager(t, config, nil, nil).Select("hedged")
+
+	ctx := context.Background()
+	assert.NoError(t, hedged.Set(ctx, "hedged_item", TestType{Name: "hedged"}))
+	var cached TestType
+	for i := 0; i < 20; i++ {
+		startMarker := time.Now()
+		assert.NoError(t, hedged.Get(ctx, "hedged_item", &cached))
+		assert.Less(t, time.Since(startMarker), time.Second, "read waited for the stuck replica")
+	}
+
+	stats := hedged.Stats().Layers[0]
+	assert.Positive(t, stats.HedgesWon)
+	assert.LessOrEqual(t, stats.HedgesWon, stats.Hedges)
+}
+
+func TestTimeoutBudgets(t *testing.T) {
+	stuck := stuckRedisServer(t)
+	config := setupTestConfig(t)
+	for _, name := range []string{"budget", "sliced"} {
+		config.Set("cache."+name+".soft-ttl", "1h")
+		config.Set("cache."+name+".layers", []string{"stuck-redis", "tiny-layer"})
+		config.Set("cache."+name+".stuck-redis.type", "redis")
+		config.Set("cache."+name+".stuck-redis.address", stuck)
+		config.Set("cache."+name+".stuck-redis.read-timeout", "1s")
+		config.Set("cache."+name+".stuck-redis.write-timeout", "1s")
+		config.Set("cache."+name+".tiny-layer.type", "tiny")
+	}
+	config.Set("cache.budget.timeout", "200ms")
+	config.Set("cache.sliced.stuck-redis.op-timeout", "50ms")
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+
+	ctx := context.Background()
+	for _, name := range []string{"budget", "sliced"} {
+		instance := mnemosyneManager.Select(name)
+		startMarker := time.Now()
+		err := instance.Set(ctx, "budget_item", TestType{Name: name})
+		assert.ErrorIs(t, err, context.DeadlineExceeded, name)
+		assert.NotContains(t, err.Error(), "tiny-layer", "%s: the last layer should get the unused budget", name)
+		assert.Less(t, time.Since(startMarker), 500*time.Millisecond, name)
+
+		startMarker = time.Now()
+		var cached TestType
+		assert.NoError(t, instance.Get(ctx, "budget_item", &cached), name)
+		assert.Equal(t, name, cached.Name)
+		assert.Less(t, time.Since(startMarker), 500*time.Millisecond, name)
+	}
+
+	expired, cancel := context.WithTimeout(ctx, -time.Second)
+	defer cancel()
+	var cached TestType
+	assert.ErrorIs(t, mnemosyneManager.Select("sliced").Get(expired, "budget_item", &cached), mnemosyne.ErrNotFound)
+}
+
+func TestRefreshLease(t *testing.T) {
+	redisServer := testRedisServer(t)
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", redisServer.Addr())
+	addTinyInstance(config, "tiny", nil)
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+	cacheInstance := mnemosyneManager.Select("result")
+	ctx := context.Background()
+
+	lease, err := cacheInstance.AcquireRefreshLease(ctx, "leased", time.Second)
+	assert.NoError(t, err)
+	_, err = cacheInstance.AcquireRefreshLease(ctx, "leased", time.Second)
+	assert.ErrorIs(t, err, mnemosyne.ErrLeaseHeld)
+
+	// an expired lease taken over by another process must survive the release
+	redisServer.FastForward(2 * time.Second)
+	other, err := cacheInstance.AcquireRefreshLease(ctx, "leased", time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, lease.Release(ctx))
+	_, err = cacheInstance.AcquireRefreshLease(ctx, "leased", time.Second)
+	assert.ErrorIs(t, err, mnemosyne.ErrLeaseHeld)
+	assert.NoError(t, other.Release(ctx))
+	lease, err = cacheInstance.AcquireRefreshLease(ctx, "leased", time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, lease.Release(ctx))
+
+	_, err = cacheInstance.AcquireRefreshLease(ctx, "forever", 0)
+	assert.Error(t, err, "a lease needs an expiry")
+	assert.False(t, redisServer.DB(config.GetInt("cache.result.user-redis.db")).Exists("mnemosyne-lease:forever"))
+
+	_, err = mnemosyneManager.Select("tiny").AcquireRefreshLease(ctx, "leased", time.Second)
+	assert.ErrorIs(t, err, mnemosyne.ErrNoRedisLayer)
+}
+
+func TestRefreshLeaseLostReply(t *testing.T) {
+	redisServer := testRedisServer(t)
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", lossyRedisServer(t, redisServer.Addr(), "mnemosyne-lease:"))
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+	ctx := context.Background()
+
+	lease, err := mnemosyneManager.Select("result").AcquireRefreshLease(ctx, "lost", time.Second)
+	assert.NoError(t, err, "the lease taken by the attempt whose reply was lost is ours")
+	leases := redisServer.DB(config.GetInt("cache.result.user-redis.db"))
+	assert.True(t, leases.Exists("mnemosyne-lease:lost"))
+	assert.NoError(t, lease.Release(ctx))
+	assert.False(t, leases.Exists("mnemosyne-lease:lost"))
+}
+
+func TestGetOrLoad(t *testing.T) {
+	config := setupTestConfig(t)
+	cacheInstance := newTestManager(t, config, nil, nil).Select("result")
+	ctx := context.Background()
+
+	var loads atomic.Int32
+	load := func(context.Context) (interface{}, error) {
+		loads.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return TestType{Name: "loaded"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cached TestType
+			assert.NoError(t, cacheInstance.GetOrLoad(ctx, "loaded_item", &cached, load))
+			assert.Equal(t, "loaded", cached.Name)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), loads.Load(), "only the lease holder should load")
+	stats := cacheInstance.Stats()
+	assert.LessOrEqual(t, stats.Misses, int64(10), "waiting for the holder should not count as misses")
+	assert.LessOrEqual(t, stats.Hits, int64(10))
+
+	failing := func(context.Context) (interface{}, error) {
+		return nil, errors.New("backend is down")
+	}
+	var cached TestType
+	assert.EqualError(t, cacheInstance.GetOrLoad(ctx, "missing_item", &cached, failing), "backend is down")
+	assert.NoError(t, cacheInstance.GetOrLoad(ctx, "loaded_item", &cached, failing), "fresh values are served without loading")
+}
+
+func TestGetOrLoadWithOpenBreaker(t *testing.T) {
+	redisServer := testRedisServer(t)
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", redisServer.Addr())
+	config.Set("cache.result.user-redis.breaker-error-rate", 1)
+	config.Set("cache.result.user-redis.breaker-window", 2)
+	config.Set("cache.result.user-redis.breaker-cooldown", "100ms")
+	cacheInstance := newTestManager(t, config, nil, nil).Select("result")
+	ctx := context.Background()
+
+	redisServer.SetError("ERR lease layer is down")
+	var cached TestType
+	for range 2 {
+		assert.ErrorIs(t, cacheInstance.Get(ctx, "breaker_item", &cached), mnemosyne.ErrNotFound)
+	}
+	assert.Equal(t, mnemosyne.BreakerOpen, cacheInstance.Stats().Layers[1].Breaker)
+	redisServer.SetError("")
+
+	var loads atomic.Int32
+	load := func(context.Context) (interface{}, error) {
+		loads.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return TestType{Name: "loaded"}, nil
+	}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cached TestType
+			assert.NoError(t, cacheInstance.GetOrLoad(ctx, "breaker_item", &cached, load))
+			assert.Equal(t, "loaded", cached.Name)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), loads.Load(), "an open breaker should not let every caller load")
+}
+
+func TestWarm(t *testing.T) {
+	config := setupTestConfig(t)
+	cacheInstance := newTestManager(t, config, nil, nil).Select("result")
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, cacheInstance.Set(ctx, fmt.Sprintf("warm:%d", i), TestType{Name: "warm"}))
+	}
+	assert.NoError(t, cacheInstance.Flush("user-memory"))
+
+	var reports []mnemosyne.WarmProgress
+	progress, err := cacheInstance.Warm(ctx, mnemosyne.WarmOptions{
+		Keys:     []string{"warm:missing"},
+		Pattern:  "warm:1*",
+		Progress: func(p mnemosyne.WarmProgress) { reports = append(reports, p) },
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, mnemosyne.WarmProgress{Warmed: 11, Missed: 1, Done: true, Complete: true}, progress)
+	assert.Equal(t, progress, reports[len(reports)-1])
+	assert.True(t, cacheInstance.Inspect(ctx, "warm:15")[0].Present, "memory layer was not warmed")
+	assert.False(t, cacheInstance.Inspect(ctx, "warm:5")[0].Present, "key outside the pattern was warmed")
+
+	progress, err = cacheInstance.Warm(ctx, mnemosyne.WarmOptions{Pattern: "warm:*", Limit: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, progress.Warmed)
+
+	_, err = cacheInstance.Warm(ctx, mnemosyne.WarmOptions{From: "nope"})
+	assert.ErrorIs(t, err, mnemosyne.ErrLayerNotFound)
+
+	// a new process warms its memory layer on its own at startup
+	config.Set("cache.result.warm.pattern", "warm:*")
+	config.Set("cache.result.warm.concurrency", 2)
+	restarted := newTestManager(t, config, nil, nil).Select("result")
+	select {
+	case <-restarted.WarmDone():
+	case <-time.After(time.Second):
+		t.Fatal("warm-up did not finish")
+	}
+	assert.True(t, restarted.Inspect(ctx, "warm:5")[0].Present, "memory layer was not warmed at startup")
+	select {
+	case <-cacheInstance.WarmDone():
+	default:
+		t.Error("WarmDone of an instance without warm-up should be closed")
+	}
+
+	// Close waits for a warm-up it interrupts
+	closed := mnemosyne.NewMnemosyne(config, nil, nil).Select("result")
+	assert.NoError(t, closed.Close())
+	select {
+	case <-closed.WarmDone():
+	default:
+		t.Error("Close returned while the warm-up was running")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	redisServer := testRedisServer(t)
+	snapshotFile := filepath.Join(t.TempDir(), "tiny.snapshot")
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", redisServer.Addr())
+	config.Set("cache.result.snapshot-file", filepath.Join(t.TempDir(), "result.snapshot"))
+	addTinyInstance(config, "tiny", map[string]interface{}{"ttl": "1h"})
+	config.Set("cache.tiny.snapshot-file", snapshotFile)
+	ctx := context.Background()
+
+	before := mnemosyne.NewMnemosyne(config, nil, nil)
+	assert.NoError(t, before.Select("tiny").Set(ctx, "snap_item", TestType{Name: "tiny"}))
+	assert.NoError(t, before.Select("result").Set(ctx, "snap_item", TestType{Name: "memory"}))
+	_, ttlBefore := before.Select("tiny").TTL("snap_item")
+	assert.NoError(t, before.Close())
+	redisServer.FlushAll()
+
+	after := newTestManager(t, config, nil, nil)
+	var cached TestType
+	assert.NoError(t, after.Select("tiny").Get(ctx, "snap_item", &cached))
+	assert.Equal(t, "tiny", cached.Name)
+	_, ttlAfter := after.Select("tiny").TTL("snap_item")
+	assert.InDelta(t, ttlBefore, ttlAfter, float64(time.Second), "remaining TTL was not preserved")
+	assert.NoError(t, after.Select("result").Get(ctx, "snap_item", &cached))
+	assert.Equal(t, "memory", cached.Name)
+
+	var buf bytes.Buffer
+	assert.NoError(t, after.Select("tiny").Snapshot(&buf))
+	restored, err := after.Select("result").Restore(&buf)
+	assert.NoError(t, err)
+	assert.Zero(t, restored, "entries of other layers should be dropped")
+	_, err = after.Select("tiny").Restore(strings.NewReader("garbage"))
+	assert.Error(t, err)
+
+	buf.Reset()
+	assert.NoError(t, after.Select("tiny").Snapshot(&buf))
+	config.Set("cache.tiny.snapshot-file", "")
+	config.Set("cache.tiny.tiny-layer.max-value-size", 16)
+	limited := newTestManager(t, config, nil, nil).Select("tiny")
+	restored, err = limited.Restore(&buf)
+	assert.NoError(t, err)
+	assert.Zero(t, restored, "entries above max-value-size should not be restored")
+	assert.False(t, limited.Inspect(ctx, "snap_item")[0].Present)
+
+	// an entry the memory layer rejects must not keep the others out
+	buf.Reset()
+	config.Set("cache.result.snapshot-file", "")
+	config.Set("cache.result.user-memory.compression", false)
+	source := newTestManager(t, config, nil, nil).Select("result")
+	assert.NoError(t, source.Set(ctx, "huge_item", TestType{Name: strings.Repeat("x", 4096)}))
+	assert.NoError(t, source.Set(ctx, "small_item", TestType{Name: "small"}))
+	assert.NoError(t, source.Snapshot(&buf))
+	config.Set("cache.result.user-memory.max-memory", 1)
+	config.Set("cache.result.user-memory.shards", 1024)
+	sharded := newTestManager(t, config, nil, nil).Select("result")
+	restored, err = sharded.Restore(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored, "entries larger than a shard should be skipped")
+	assert.True(t, sharded.Inspect(ctx, "small_item")[0].Present)
+}
+
+func TestMaxValueSize(t *testing.T) {
+	config := setupTestConfig(t)
+	config.Set("cache.result.user-memory.max-value-size", 128)
+	config.Set("cache.result.user-memory.compression", false)
+	cacheInstance := newTestManager(t, config, nil, nil).Select("result")
+	ctx := context.Background()
+	big := TestType{Name: strings.Repeat("x", 256)}
+
+	assert.NoError(t, cacheInstance.Set(ctx, "sized_item", TestType{Name: "small"}))
+	assert.NoError(t, cacheInstance.Set(ctx, "sized_item", big), "oversized values should skip the layer")
+	var cached TestType
+	assert.NoError(t, cacheInstance.Get(ctx, "sized_item", &cached))
+	assert.Equal(t, big.Name, cached.Name, "the stale small value should have been removed")
+	assert.NoError(t, cacheInstance.Get(ctx, "sized_item", &cached))
+	stats := cacheInstance.Stats()
+	assert.Equal(t, int64(1), stats.Layers[0].Oversized, "reads should not count as oversized writes")
+	assert.Zero(t, stats.Layers[0].BackFills, "oversized values should not be counted as back-filled")
+	assert.Equal(t, int64(2), stats.Layers[1].Served)
+
+	config.Set("cache.result.user-memory.oversize", "error")
+	strict := newTestManager(t, config, nil, nil).Select("result")
+	err := strict.Set(ctx, "strict_item", big)
+	assert.ErrorIs(t, err, mnemosyne.ErrValueTooLarge)
+	assert.NoError(t, strict.Get(ctx, "strict_item", &cached), "lower layers should still be written")
+}
+
+func TestDiskLayer(t *testing.T) {
+	dir := t.TempDir()
+	config := viper.New()
+	config.Set("cache.disk.soft-ttl", "1h")
+	config.Set("cache.disk.layers", []string{"disk-layer"})
+	config.Set("cache.disk.disk-layer.type", "disk")
+	config.Set("cache.disk.disk-layer.directory", dir)
+	config.Set("cache.disk.disk-layer.ttl", "1h")
+	config.Set("cache.disk.disk-layer.max-bytes", 2048)
+	ctx := context.Background()
+
+	before := mnemosyne.NewMnemosyne(config, nil, nil)
+	assert.NoError(t, before.Select("disk").Set(ctx, "disk_item", TestType{Name: "disk"}))
+	assert.NoError(t, before.Close())
+
+	after := newTestManager(t, config, nil, nil)
+	cacheInstance := after.Select("disk")
+	var cached TestType
+	assert.NoError(t, cacheInstance.Get(ctx, "disk_item", &cached), "entries should survive a restart")
+	assert.Equal(t, "disk", cached.Name)
+	_, ttl := cacheInstance.TTL("disk_item")
+	assert.InDelta(t, time.Hour, ttl, float64(time.Second))
+
+	assert.NoError(t, cacheInstance.Delete(ctx, "disk_item"))
+	assert.ErrorIs(t, cacheInstance.Get(ctx, "disk_item", &cached), mnemosyne.ErrNotFound)
+
+	for i := range 50 {
+		assert.NoError(t, cacheInstance.Set(ctx, fmt.Sprintf("disk_item_%d", i), TestType{Name: strings.Repeat("x", 100)}))
+	}
+	assert.Eventually(t, func() bool {
+		layer := cacheInstance.Stats().Layers[0]
+		return layer.Evictions > 0 && layer.BytesStored <= 2048
+	}, time.Second, 10*time.Millisecond, "the layer should be compacted down to max-bytes")
+	assert.NoError(t, cacheInstance.Get(ctx, "disk_item_49", &cached), "the newest entry should be kept")
+
+	config.Set("cache.broken.soft-ttl", "1h")
+	config.Set("cache.broken.layers", []string{"broken-disk"})
+	config.Set("cache.broken.broken-disk.type", "disk")
+	broken := newTestManager(t, config, nil, nil)
+	assert.NotContains(t, broken.Instances(), "broken", "disk layers need a directory")
+	assert.Panics(t, func() { broken.Select("broken") })
+}
+
+func TestStorageEnvelope(t *testing.T) {
+	redisServer := testRedisServer(t)
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", redisServer.Addr())
+	config.Set("cache.result.user-redis.db", 0)
+	cacheInstance := newTestManager(t, config, nil, nil).Select("result")
+	ctx := context.Background()
+
+	assert.NoError(t, cacheInstance.Set(ctx, "enveloped_item", TestType{Name: "enveloped"}))
+	stored, err := redisServer.Get("enveloped_item")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored, "\x89MNE"), "values should be stored in an envelope")
+	inspected := cacheInstance.Inspect(ctx, "enveloped_item")
+	assert.Equal(t, 2*time.Hour, inspected[1].SoftTTL)
+	assert.WithinDuration(t, time.Now(), inspected[1].WrittenAt, time.Second)
+
+	assert.NoError(t, cacheInstance.SetWithCost(ctx, "costly_item", TestType{Name: "costly"}, time.Minute))
+	costly, err := redisServer.Get("costly_item")
+	assert.NoError(t, err)
+	assert.NotContains(t, costly, "Delta", "the recompute cost belongs in the header")
+	assert.Equal(t, time.Minute, cacheInstance.Inspect(ctx, "costly_item")[1].Cost)
+
+	legacy, err := json.Marshal(map[string]interface{}{"Time": time.Now(), "CachedObject": TestType{Name: "legacy"}})
+	assert.NoError(t, err)
+	assert.NoError(t, redisServer.Set("legacy_item", string(mnemosyne.CompressZlib(legacy))))
+	var cached TestType
+	assert.NoError(t, cacheInstance.Get(ctx, "legacy_item", &cached), "legacy values should stay readable")
+	assert.Equal(t, "legacy", cached.Name)
+
+	corrupt := []byte(stored)
+	corrupt[len(corrupt)-1] ^= 0xff
+	assert.NoError(t, redisServer.Set("corrupt_item", string(corrupt)))
+	assert.ErrorIs(t, cacheInstance.Get(ctx, "corrupt_item", &cached), mnemosyne.ErrNotFound)
+
+	unknown := []byte(stored)
+	unknown[4] = 99
+	assert.NoError(t, redisServer.Set("unknown_item", string(unknown)))
+	assert.ErrorIs(t, cacheInstance.Get(ctx, "unknown_item", &cached), mnemosyne.ErrNotFound)
+
+	stats := cacheInstance.Stats().Layers[1]
+	assert.Equal(t, int64(2), stats.Corrupt, "corrupt values should be counted apart from misses")
+	assert.Zero(t, stats.Errors, "corrupt values are read like misses, not errors")
+	assert.Equal(t, int64(2), stats.Misses)
+
+	// during a rolling upgrade values are written in the legacy format
+	config.Set("cache.result.user-redis.storage-format", mnemosyne.StorageLegacy)
+	upgrading := newTestManager(t, config, nil, nil).Select("result")
+	assert.NoError(t, upgrading.Set(ctx, "legacy_written_item", TestType{Name: "old readers"}))
+	stored, err = redisServer.Get("legacy_written_item")
+	assert.NoError(t, err)
+	assert.False(t, strings.HasPrefix(stored, "\x89MNE"), "the legacy format should be written")
+	assert.NoError(t, cacheInstance.Get(ctx, "legacy_written_item", &cached))
+	assert.Equal(t, "old readers", cached.Name)
+
+	config.Set("cache.result.user-redis.storage-format", "xml")
+	assert.Panics(t, func() { mnemosyne.NewMnemosyne(config, nil, nil) }, "unknown storage formats should be rejected")
+}
+
+func TestMemoryLayerTuningAndStats(t *testing.T) {
+	config := setupTestConfig(t)
+	config.Set("cache.result.user-memory.shards", 16)
+	config.Set("cache.result.user-memory.max-entry-size", 1024)
+	config.Set("cache.broken.soft-ttl", "1h")
+	config.Set("cache.broken.layers", []string{"broken-memory"})
+	config.Set("cache.broken.broken-memory.type", "memory")
+	config.Set("cache.broken.broken-memory.shards", 3)
+
+	mnemosyneManager := newTestManager(t, config, nil, nil)
+	assert.Panics(t, func() { mnemosyneManager.Select("broken") }, "invalid shards should be rejected")
+
+	cacheInstance := mnemosyneManager.Select("result")
+	ctx := context.Background()
+	assert.NoError(t, cacheInstance.Set(ctx, "stats_item", TestType{Name: "stats"}))
+	var cached TestType
+	assert.NoError(t, cacheInstance.Get(ctx, "stats_item", &cached))
+
+	stats := cacheInstance.MemoryStats()["user-memory"]
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, 1, stats.Entries)
+}
+
+func TestKeys(t *testing.T) {
+	redisServer := testRedisServer(t)
+	config := newTestConfig()
+	config.Set("cache.result.user-redis.address", redisServer.Addr())
+	cacheInstance := newTestManager(t, config, nil, nil).Select("result")
+	ctx := context.Background()
+
+	for _, key := range []string{"user:1", "user:2", "item:1"} {
+		assert.NoError(t, cacheInstance.Set(ctx, key, TestType{Name: key}))
+	}
+	// the db of the layer is the namespace of the instance
+	assert.NoError(t, redisServer.DB(config.GetInt("cache.result.user-redis.db")+1).Set("user:3", "other instance"))
+
+	for _, layer := range []string{"user-memory", "user-redis"} {
+		var keys []string
+		for key, err := range cacheInstance.Keys(ctx, layer, "user:[0-9]") {
+			assert.NoError(t, err)
+			keys = append(keys, key)
+		}
+		assert.ElementsMatch(t, []string{"user:1", "user:2"}, keys, "layer %s", layer)
+	}
+
+	for _, err := range cacheInstance.Keys(ctx, "no-such-layer", "*") {
+		assert.ErrorIs(t, err, mnemosyne.ErrLayerNotFound)
+	}
+
+	// leases live next to the values but are not values
+	lease, err := cacheInstance.AcquireRefreshLease(ctx, "user:1", time.Minute)
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, lease.Release(ctx)) }()
+	var keys []string
+	for key, err := range cacheInstance.Keys(ctx, "user-redis", "") {
+		assert.NoError(t, err)
+		keys = append(keys, key)
+	}
+	assert.ElementsMatch(t, []string{"user:1", "user:2", "item:1"}, keys)
+	progress, err := cacheInstance.Warm(ctx, mnemosyne.WarmOptions{Pattern: "*"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, progress.Warmed)
+	assert.Zero(t, cacheInstance.Stats().Layers[1].Corrupt)
+}
@@ -0,0 +1,277 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/mnemosyne"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLegacyCountersAndObserver(t *testing.T) {
+	config := setupTestConfig(t)
+	counter := newRecordingCounter()
+	var mu sync.Mutex
+	var events []mnemosyne.Event
+	observer := mnemosyne.ObserverFunc(func(event mnemosyne.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	})
+	cacheInstance := newTestManager(t, config, nil, counter, mnemosyne.WithObserver(observer)).Select("result")
+
+	ctx := context.Background()
+	var cached TestType
+	assert.NoError(t, cacheInstance.Set(ctx, "observed_item", TestType{Name: "observed"}))
+	assert.NoError(t, cacheInstance.Get(ctx, "observed_item", &cached))
+	assert.Error(t, cacheInstance.Get(ctx, "missing_item", &cached))
+
+	assert.Equal(t, 1, counter.count("result", "user-memory"))
+	assert.Equal(t, 1, counter.count("result", "miss"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, events, mnemosyne.Event(mnemosyne.Miss{Instance: "result"}))
+	var setDone mnemosyne.SetDone
+	for _, event := range events {
+		if e, ok := event.(mnemosyne.SetDone); ok && e.Layer == "user-redis" {
+			setDone = e
+		}
+	}
+	assert.True(t, setDone.Compressed)
+	assert.Positive(t, setDone.Bytes)
+	assert.NoError(t, setDone.Err)
+}
+
+func TestTTLOfMissingKey(t *testing.T) {
+	config := setupTestConfig(t)
+	var mu sync.Mutex
+	results := map[string]string{}
+	observer := mnemosyne.ObserverFunc(func(event mnemosyne.Event) {
+		if e, ok := event.(mnemosyne.OpDone); ok && e.Op == "ttl" {
+			mu.Lock()
+			defer mu.Unlock()
+			results[e.Layer] = e.Result
+		}
+	})
+	cacheInstance := newTestManager(t, config, nil, nil, mnemosyne.WithObserver(observer)).Select("result")
+
+	layer, ttl := cacheInstance.TTL("missing_item")
+	assert.Equal(t, -1, layer)
+	assert.Zero(t, ttl)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "miss", results["user-redis"])
+	assert.Equal(t, "miss", results["user-memory"])
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	config := setupTestConfig(t)
+	metrics := mnemosyne.NewPrometheusMetrics()
+	cacheInstance := newTestManager(t, config, nil, nil, mnemosyne.WithObserver(metrics)).Select("result")
+
+	ctx := context.Background()
+	var cached TestType
+	assert.NoError(t, cacheInstance.Set(ctx, "metrics_item", TestType{Name: "metrics"}))
+	assert.NoError(t, cacheInstance.Get(ctx, "metrics_item", &cached))
+	assert.ErrorIs(t, cacheInstance.Get(ctx, "missing_item", &cached), mnemosyne.ErrNotFound)
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	assert.Contains(t, body, `mnemosyne_hits_total{instance="result",layer="user-memory"} 1`)
+	assert.Contains(t, body, `mnemosyne_misses_total{instance="result"} 1`)
+	assert.Contains(t, body, "# TYPE mnemosyne_operation_duration_seconds histogram\n")
+	assert.Contains(t, body, `mnemosyne_operation_duration_seconds_count{instance="result",layer="user-redis",operation="set",result="ok"} 1`)
+	assert.Contains(t, body, `mnemosyne_operation_duration_seconds_bucket{instance="result",layer="user-redis",operation="set",result="ok",le="+Inf"} 1`)
+	assert.Contains(t, body, `mnemosyne_written_bytes_total{instance="result",layer="user-redis"}`)
+	assert.Contains(t, body, `mnemosyne_operation_duration_seconds_count{instance="result",layer="user-memory",operation="get",result="ok"} 1`)
+	assert.Contains(t, body, `mnemosyne_operation_duration_seconds_count{instance="result",layer="user-memory",operation="get",result="miss"} 1`)
+	assert.Contains(t, body, `mnemosyne_memory_hits_total{instance="result",layer="user-memory"} 1`)
+	assert.Contains(t, body, `mnemosyne_memory_misses_total{instance="result",layer="user-memory"} 1`)
+	assert.Contains(t, body, `mnemosyne_memory_collisions_total{instance="result",layer="user-memory"} 0`)
+
+	assert.NoError(t, cacheInstance.Get(ctx, "metrics_item", &cached))
+	rec = httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), `mnemosyne_memory_hits_total{instance="result",layer="user-memory"} 2`, "memory statistics should be sampled on every scrape")
+}
+
+func TestPrometheusMetricsPositionalLabels(t *testing.T) {
+	config := setupTestConfig(t)
+	metrics := mnemosyne.NewPrometheusMetrics()
+	cacheInstance := newTestManager(t, config, metrics, metrics).Select("result")
+
+	ctx := context.Background()
+	var cached TestType
+	assert.NoError(t, cacheInstance.Set(ctx, "positional_item", TestType{Name: "positional"}))
+	assert.NoError(t, cacheInstance.Get(ctx, "positional_item", &cached))
+	assert.ErrorIs(t, cacheInstance.Get(ctx, "missing_item", &cached), mnemosyne.ErrNotFound)
+	metrics.Inc("result-hotness", "hot")
+	metrics.Inc("tiny-layer-eviction", "capacity")
+	metrics.Inc("some", "unknown", "labels")
+	metrics.Done(metrics.Start(), "user-redis", "ttl")
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, `mnemosyne_hits_total{instance="result",layer="user-memory"} 1`)
+	assert.Contains(t, body, `mnemosyne_misses_total{instance="result"} 1`)
+	assert.Contains(t, body, `mnemosyne_hotness_total{instance="result",hotness="hot"} 1`)
+	assert.Contains(t, body, `mnemosyne_operation_duration_seconds_count{instance="",layer="user-redis",operation="set",result="ok"} 1`)
+	assert.Contains(t, body, `mnemosyne_operation_duration_seconds_count{instance="",layer="user-memory",operation="get",result="miss"} 1`)
+	assert.Contains(t, body, `mnemosyne_operation_duration_seconds_count{instance="",layer="user-redis",operation="ttl",result=""} 1`)
+	assert.Contains(t, body, `mnemosyne_evictions_total{instance="",layer="tiny-layer",reason="capacity"} 1`)
+	assert.Contains(t, body, `mnemosyne_events_total{event="some/unknown/labels"} 1`)
+}
+
+func TestPrometheusMetricsAsCounterAndObserver(t *testing.T) {
+	config := setupTestConfig(t)
+	metrics := mnemosyne.NewPrometheusMetrics()
+	cacheInstance := newTestManager(t, config, metrics, metrics, mnemosyne.WithObserver(metrics)).Select("result")
+
+	ctx := context.Background()
+	var cached TestType
+	assert.NoError(t, cacheInstance.Set(ctx, "counted_item", TestType{Name: "counted"}))
+	assert.NoError(t, cacheInstance.Get(ctx, "counted_item", &cached))
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, `mnemosyne_hits_total{instance="result",layer="user-memory"} 1`, "events should be counted once")
+	assert.Contains(t, body, `mnemosyne_operation_duration_seconds_count{instance="result",layer="user-memory",operation="get",result="ok"} 1`)
+	assert.NotContains(t, body, `instance=""`, "the positional labels should not be used")
+}
+
+func TestPrometheusEvictionsPerInstance(t *testing.T) {
+	metrics := mnemosyne.NewPrometheusMetrics()
+	metrics.Observe(mnemosyne.Evict{Instance: "users", Layer: "memory", Reason: "capacity"})
+	metrics.Observe(mnemosyne.Evict{Instance: "results", Layer: "memory", Reason: "capacity"})
+	metrics.Observe(mnemosyne.Evict{Instance: "results", Layer: "memory", Reason: "capacity"})
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, `mnemosyne_evictions_total{instance="users",layer="memory",reason="capacity"} 1`)
+	assert.Contains(t, body, `mnemosyne_evictions_total{instance="results",layer="memory",reason="capacity"} 2`)
+}
+
+// recordingTracer keeps the attributes of every ended span by span name
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans map[string][]map[string]any
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	name   string
+	attrs  map[string]any
+}
+
+func (rt *recordingTracer) Start(ctx context.Context, name string) (context.Context, mnemosyne.Span) {
+	return ctx, &recordingSpan{tracer: rt, name: name, attrs: make(map[string]any)}
+}
+
+func (rs *recordingSpan) SetAttributes(attrs ...mnemosyne.Attribute) {
+	for _, attr := range attrs {
+		rs.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (rs *recordingSpan) End() {
+	rs.tracer.mu.Lock()
+	defer rs.tracer.mu.Unlock()
+	rs.tracer.spans[rs.name] = append(rs.tracer.spans[rs.name], rs.attrs)
+}
+
+func TestTracer(t *testing.T) {
+	config := setupTestConfig(t)
+	tracer := &recordingTracer{spans: make(map[string][]map[string]any)}
+	cacheInstance := newTestManager(t, config, nil, nil, mnemosyne.WithTracer(tracer)).Select("result")
+
+	ctx := context.Background()
+	var cached TestType
+	assert.NoError(t, cacheInstance.Set(ctx, "traced_item", TestType{Name: "traced"}))
+	tracer.mu.Lock()
+	assert.Len(t, tracer.spans["mnemosyne.Set"], 1)
+	assert.Len(t, tracer.spans["mnemosyne.layer.set"], 2)
+	tracer.mu.Unlock()
+
+	assert.NoError(t, cacheInstance.Flush("user-memory"))
+	assert.NoError(t, cacheInstance.Get(ctx, "traced_item", &cached))
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if assert.Len(t, tracer.spans["mnemosyne.Get"], 1) {
+		get := tracer.spans["mnemosyne.Get"][0]
+		assert.Equal(t, true, get[mnemosyne.AttrHit])
+		assert.Equal(t, "user-redis", get[mnemosyne.AttrLayer])
+		assert.Equal(t, "result", get[mnemosyne.AttrInstance])
+		assert.NotEmpty(t, get[mnemosyne.AttrKeyHash])
+	}
+	var results []any
+	for _, span := range tracer.spans["mnemosyne.layer.get"] {
+		results = append(results, span[mnemosyne.AttrResult])
+	}
+	assert.ElementsMatch(t, []any{"miss", "ok"}, results)
+	assert.Len(t, tracer.spans["mnemosyne.decode"], 1)
+}
+
+func TestStats(t *testing.T) {
+	config := setupTestConfig(t)
+	manager := newTestManager(t, config, nil, nil)
+	cacheInstance := manager.Select("result")
+
+	ctx := context.Background()
+	var cached TestType
+	assert.NoError(t, cacheInstance.Set(ctx, "stats_item", TestType{Name: "stats"}))
+	assert.NoError(t, cacheInstance.Get(ctx, "stats_item", &cached))
+	assert.Error(t, cacheInstance.Get(ctx, "missing_item", &cached))
+	// diagnostic and warm-up reads are not traffic
+	cacheInstance.Inspect(ctx, "stats_item")
+	cacheInstance.Inspect(ctx, "missing_item")
+	_, err := cacheInstance.Warm(ctx, mnemosyne.WarmOptions{Keys: []string{"stats_item"}})
+	assert.NoError(t, err)
+
+	stats := cacheInstance.Stats()
+	assert.Equal(t, "result", stats.Name)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.InDelta(t, 0.5, stats.HitRatio, 0.001)
+	if assert.Len(t, stats.Layers, 2) {
+		memory, redis := stats.Layers[0], stats.Layers[1]
+		assert.Equal(t, "user-memory", memory.Name)
+		assert.Equal(t, int64(1), memory.Served)
+		assert.Equal(t, int64(2), memory.Sets, "the warm-up writes are counted")
+		assert.Positive(t, memory.BytesWritten)
+		assert.Positive(t, memory.BytesAllocated)
+		assert.Zero(t, memory.BytesStored, "bigcache does not report the size of its entries")
+		assert.Positive(t, memory.GetLatency.Max)
+		assert.Equal(t, int64(1), memory.Hits)
+		assert.Equal(t, int64(1), memory.Misses)
+		assert.Equal(t, int64(1), redis.Misses)
+		assert.Zero(t, redis.Hits)
+	}
+
+	assert.Contains(t, manager.Stats(), "result")
+	// expvar names are process-wide, keep them unique across -count runs
+	name := fmt.Sprintf("mnemosyne_test_stats_%d", time.Now().UnixNano())
+	errs := make(chan error, 4)
+	for range cap(errs) {
+		go func() { errs <- manager.PublishExpvar(name) }()
+	}
+	published := 0
+	for range cap(errs) {
+		if <-errs == nil {
+			published++
+		}
+	}
+	assert.Equal(t, 1, published, "concurrent calls should publish the name once")
+	assert.Error(t, manager.PublishExpvar(name))
+}
@@ -0,0 +1,219 @@
+package mnemosyne
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// tinyStore holds the entries of a tiny layer
+type tinyStore interface {
+	load(key string) (*memEntry, bool)
+	store(key string, entry *memEntry)
+	remove(key string)
+	// removeIf removes key only if it still holds entry
+	removeIf(key string, entry *memEntry)
+	clear()
+	each(fn func(key string, entry *memEntry) bool)
+	// size returns the bytes held by keys and values
+	size() int64
+}
+
+// newTinyStore returns an unbounded sync.Map based store unless a limit is
+// configured, in which case entries are evicted according to the policy.
+// onEvict is called for every evicted entry and onOversize for every entry
+// larger than maxBytes, which is not stored at all.
+func newTinyStore(maxEntries int, maxBytes int64, policyName string, onEvict func(), onOversize func(size int64)) (tinyStore, error) {
+	if maxEntries <= 0 && maxBytes <= 0 {
+		return &syncMapStore{}, nil
+	}
+	policy, err := newEvictionPolicy(policyName, maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &boundedStore{
+		entries:    make(map[string]*memEntry),
+		policy:     policy,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		onEvict:    onEvict,
+		onOversize: onOversize,
+	}, nil
+}
+
+type syncMapStore struct {
+	data  sync.Map
+	bytes atomic.Int64
+}
+
+func (s *syncMapStore) load(key string) (*memEntry, bool) {
+	val, ok := s.data.Load(key)
+	if !ok {
+		return nil, false
+	}
+	entry, ok := val.(*memEntry)
+	return entry, ok
+}
+
+func (s *syncMapStore) store(key string, entry *memEntry) {
+	s.bytes.Add(entrySize(key, entry))
+	if old, loaded := s.data.Swap(key, entry); loaded {
+		s.bytes.Add(-entrySize(key, old.(*memEntry)))
+	}
+}
+
+func (s *syncMapStore) remove(key string) {
+	if old, loaded := s.data.LoadAndDelete(key); loaded {
+		s.bytes.Add(-entrySize(key, old.(*memEntry)))
+	}
+}
+
+func (s *syncMapStore) removeIf(key string, entry *memEntry) {
+	if s.data.CompareAndDelete(key, entry) {
+		s.bytes.Add(-entrySize(key, entry))
+	}
+}
+
+// clear is not atomic with concurrent stores, so size is approximate until
+// those entries are removed again
+func (s *syncMapStore) clear() {
+	s.data.Clear()
+	s.bytes.Store(0)
+}
+
+func (s *syncMapStore) size() int64 {
+	return max(s.bytes.Load(), 0)
+}
+
+func (s *syncMapStore) each(fn func(key string, entry *memEntry) bool) {
+	s.data.Range(func(key, val any) bool {
+		entry, ok := val.(*memEntry)
+		if !ok {
+			return true
+		}
+		return fn(key.(string), entry)
+	})
+}
+
+// boundedStore is a tiny layer store limited by entry count and/or bytes
+type boundedStore struct {
+	mu         sync.Mutex
+	entries    map[string]*memEntry
+	policy     evictionPolicy
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	onEvict    func()
+	onOversize func(size int64)
+}
+
+func entrySize(key string, entry *memEntry) int64 {
+	return int64(len(key) + len(entry.value))
+}
+
+func (s *boundedStore) load(key string) (*memEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if ok {
+		s.policy.access(key)
+	}
+	return entry, ok
+}
+
+func (s *boundedStore) store(key string, entry *memEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := entrySize(key, entry)
+	if s.maxBytes > 0 && size > s.maxBytes {
+		// the entry can never fit, keep the rest of the layer intact
+		if _, ok := s.entries[key]; ok {
+			s.removeLocked(key)
+		}
+		if s.onOversize != nil {
+			s.onOversize(size)
+		}
+		return
+	}
+
+	if old, ok := s.entries[key]; ok {
+		s.bytes -= entrySize(key, old)
+		s.policy.access(key)
+	} else {
+		s.policy.add(key)
+	}
+	s.entries[key] = entry
+	s.bytes += size
+
+	for s.overLimit() {
+		victim, ok := s.policy.victim()
+		if !ok {
+			break
+		}
+		s.removeLocked(victim)
+		s.evicted()
+	}
+}
+
+func (s *boundedStore) overLimit() bool {
+	return (s.maxEntries > 0 && len(s.entries) > s.maxEntries) ||
+		(s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
+func (s *boundedStore) evicted() {
+	if s.onEvict != nil {
+		s.onEvict()
+	}
+}
+
+func (s *boundedStore) removeLocked(key string) {
+	if entry, ok := s.entries[key]; ok {
+		s.bytes -= entrySize(key, entry)
+		delete(s.entries, key)
+	}
+	s.policy.remove(key)
+}
+
+func (s *boundedStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *boundedStore) removeIf(key string, entry *memEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[key] == entry {
+		s.removeLocked(key)
+	}
+}
+
+func (s *boundedStore) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = make(map[string]*memEntry)
+	s.bytes = 0
+	s.policy.reset()
+}
+
+func (s *boundedStore) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// each iterates over a copy of the entries so fn may modify the store
+func (s *boundedStore) each(fn func(key string, entry *memEntry) bool) {
+	s.mu.Lock()
+	snapshot := make(map[string]*memEntry, len(s.entries))
+	for key, entry := range s.entries {
+		snapshot[key] = entry
+	}
+	s.mu.Unlock()
+
+	for key, entry := range snapshot {
+		if !fn(key, entry) {
+			return
+		}
+	}
+}
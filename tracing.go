@@ -0,0 +1,69 @@
+package mnemosyne
+
+import (
+	"context"
+)
+
+// Tracer starts spans around cache operations. Its shape follows the
+// OpenTelemetry API so that an adapter around an OpenTelemetry tracer only
+// has to convert attributes.
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx, if any,
+	// and returns a context holding the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	End()
+}
+
+// Attribute is a key-value pair attached to a span. Value is a string, bool
+// or int.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Span attribute keys set by Mnemosyne
+const (
+	AttrInstance   = "mnemosyne.instance"
+	AttrLayer      = "mnemosyne.layer"
+	AttrKeyHash    = "mnemosyne.key_hash"
+	AttrHit        = "mnemosyne.hit"
+	AttrResult     = "mnemosyne.result"
+	AttrBytes      = "mnemosyne.bytes"
+	AttrCompressed = "mnemosyne.compressed"
+	AttrAmnesia    = "mnemosyne.amnesia"
+)
+
+// WithTracer makes all cache instances trace their operations with tracer
+func WithTracer(tracer Tracer) Option {
+	return func(o *options) {
+		o.tracer = tracer
+	}
+}
+
+type noopTracer struct{}
+
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+
+func (noopSpan) End() {}
+
+// startSpan starts a span for an operation of the layer on key
+func (cr *cache) startSpan(ctx context.Context, name, key string) (context.Context, Span) {
+	ctx, span := cr.tracer.Start(ctx, name)
+	span.SetAttributes(
+		Attribute{Key: AttrInstance, Value: cr.instanceName},
+		Attribute{Key: AttrLayer, Value: cr.layerName},
+		Attribute{Key: AttrKeyHash, Value: keyHash(key)},
+	)
+	return ctx, span
+}
@@ -3,7 +3,9 @@ package mnemosyne
 import (
 	"bytes"
 	"compress/zlib"
+	"hash/fnv"
 	"io"
+	"strconv"
 )
 
 // compressZlib compresses data using zlib
@@ -43,6 +45,14 @@ func decompressZlib(input []byte) ([]byte, error) {
 	return out.Bytes(), nil
 }
 
+// keyHash returns a short stable hash of key, used to identify keys in
+// traces and logs without exposing them
+func keyHash(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
 // Backward compatibility functions
 func CompressZlib(input []byte) []byte {
 	compressed, _ := compressZlib(input)
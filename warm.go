@@ -0,0 +1,266 @@
+package mnemosyne
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultWarmConcurrency = 8
+	defaultWarmDeadline    = 30 * time.Second
+	warmProgressEvery      = 100
+)
+
+// WarmOptions selects the keys to preload into the upper layers of an
+// instance. Keys are taken from Keys, then from a scan of From for Pattern,
+// then from Loader.
+type WarmOptions struct {
+	// From is the layer values are read from, by default the lowest one.
+	// Every layer above it is filled.
+	From    string
+	Keys    []string
+	Pattern string
+	// Loader is a caller-provided source of keys
+	Loader func(ctx context.Context) iter.Seq2[string, error]
+	// Limit caps the number of keys, 0 means no limit
+	Limit       int
+	Concurrency int
+	// Deadline bounds the whole warm-up, keys left by then are skipped
+	Deadline time.Duration
+	// Progress is called periodically and once at the end
+	Progress func(WarmProgress)
+}
+
+// WarmProgress counts the keys handled by a warm-up
+type WarmProgress struct {
+	// Warmed keys were copied into the upper layers, Missed keys were not in
+	// the source layer and Failed keys could not be read or written
+	Warmed int
+	Missed int
+	Failed int
+	// Done is set once the warm-up finished, Complete if it handled every key
+	Done     bool
+	Complete bool
+}
+
+// Warm preloads the layers above opts.From with keys read from it, so that
+// upper layers do not start empty. It returns when all keys were handled or
+// the deadline passed; running out of time is not an error.
+func (mn *MnemosyneInstance) Warm(ctx context.Context, opts WarmOptions) (WarmProgress, error) {
+	source, err := warmSource(mn.cacheLayers, opts.From)
+	if err != nil {
+		return WarmProgress{}, err
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultWarmConcurrency
+	}
+	deadline := opts.Deadline
+	if deadline <= 0 {
+		deadline = defaultWarmDeadline
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	var mu sync.Mutex
+	var progress WarmProgress
+	count := func(warmed, missed, failed int) {
+		mu.Lock()
+		defer mu.Unlock()
+		progress.Warmed += warmed
+		progress.Missed += missed
+		progress.Failed += failed
+		if opts.Progress != nil && (progress.Warmed+progress.Missed+progress.Failed)%warmProgressEvery == 0 {
+			opts.Progress(progress)
+		}
+	}
+
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				switch err := mn.warmKey(ctx, source, key); {
+				case err == nil:
+					count(1, 0, 0)
+				case outcome(err) == "miss":
+					count(0, 1, 0)
+				default:
+					count(0, 0, 1)
+				}
+			}
+		}()
+	}
+
+	var sourceErr error
+	sent := 0
+feed:
+	for key, err := range mn.warmKeys(ctx, source, opts) {
+		if err != nil {
+			sourceErr = err
+			break
+		}
+		if opts.Limit > 0 && sent >= opts.Limit {
+			break
+		}
+		select {
+		case keys <- key:
+			sent++
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(keys)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	progress.Done = true
+	progress.Complete = ctx.Err() == nil && sourceErr == nil
+	if opts.Progress != nil {
+		opts.Progress(progress)
+	}
+	if sourceErr != nil && !errors.Is(sourceErr, context.DeadlineExceeded) {
+		return progress, sourceErr
+	}
+	return progress, parent.Err()
+}
+
+// warmSource returns the index of the layer named from, or of the lowest
+// layer if from is empty
+func warmSource(layers []*cache, from string) (int, error) {
+	if from == "" {
+		return len(layers) - 1, nil
+	}
+	for i, layer := range layers {
+		if layer.layerName == from {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrLayerNotFound, from)
+}
+
+// warmKeys chains the key sources of opts
+func (mn *MnemosyneInstance) warmKeys(ctx context.Context, source int, opts WarmOptions) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		for _, key := range opts.Keys {
+			if !yield(key, nil) {
+				return
+			}
+		}
+		if opts.Pattern != "" {
+			for key, err := range mn.cacheLayers[source].keys(ctx, opts.Pattern) {
+				if !yield(key, err) {
+					return
+				}
+			}
+		}
+		if opts.Loader != nil {
+			for key, err := range opts.Loader(ctx) {
+				if !yield(key, err) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// warmKey copies key from the source layer into the layers above it. Like
+// Inspect it ignores the amnesia of the source layer.
+func (mn *MnemosyneInstance) warmKey(ctx context.Context, source int, key string) error {
+	layer := mn.cacheLayers[source].withContext(ctx)
+	// reads of the warm-up are not traffic of the source layer
+	rawBytes, err := layer.fetch(ctx, key)
+	if err != nil {
+		return err
+	}
+	value, err := layer.decode(rawBytes)
+	if err != nil {
+		layer.corrupted(key, err)
+		return err
+	}
+	var errs []error
+	for i := source - 1; i >= 0; i-- {
+		err := mn.cacheLayers[i].withContext(ctx).fill(key, *value)
+		if errors.Is(err, errTooLargeToFill) {
+			continue
+		}
+		mn.observer.Observe(Fill{Instance: mn.name, Layer: mn.cacheLayers[i].layerName, From: mn.cacheLayers[source].layerName, Err: err})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", mn.cacheLayers[i].layerName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newWarmOptions reads the warm-up of an instance from config, returning nil
+// if it has none
+func newWarmOptions(config *viper.Viper, configKeyPrefix string) (*WarmOptions, error) {
+	prefix := configKeyPrefix + ".warm"
+	if !config.IsSet(prefix) {
+		return nil, nil
+	}
+	opts := &WarmOptions{
+		From:        config.GetString(prefix + ".keys-from"),
+		Keys:        config.GetStringSlice(prefix + ".keys"),
+		Pattern:     config.GetString(prefix + ".pattern"),
+		Limit:       config.GetInt(prefix + ".limit"),
+		Concurrency: config.GetInt(prefix + ".concurrency"),
+		Deadline:    config.GetDuration(prefix + ".deadline"),
+	}
+	switch {
+	case len(opts.Keys) == 0 && opts.Pattern == "":
+		return nil, fmt.Errorf("%w: warm needs keys or a pattern", ErrInvalidConfig)
+	case opts.Limit < 0:
+		return nil, fmt.Errorf("%w: warm limit must not be negative, got %d", ErrInvalidConfig, opts.Limit)
+	case opts.Concurrency < 0:
+		return nil, fmt.Errorf("%w: warm concurrency must not be negative, got %d", ErrInvalidConfig, opts.Concurrency)
+	case opts.Deadline < 0:
+		return nil, fmt.Errorf("%w: warm deadline must not be negative, got %v", ErrInvalidConfig, opts.Deadline)
+	}
+	return opts, nil
+}
+
+// WarmDone returns a channel which is closed once the warm-up configured for
+// the instance finished, at the latest after its deadline, or right away if
+// it has none
+func (mn *MnemosyneInstance) WarmDone() <-chan struct{} {
+	return mn.warmDone
+}
+
+// startWarm runs the configured warm-up in the background, so it does not
+// delay startup. Close stops it and waits for it to return.
+func (mn *MnemosyneInstance) startWarm() {
+	if mn.warmOptions == nil {
+		close(mn.warmDone)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	mn.stopWarm = cancel
+	opts := *mn.warmOptions
+	opts.Progress = func(p WarmProgress) {
+		logrus.WithField("cache", mn.name).
+			WithField("warmed", p.Warmed).
+			WithField("missed", p.Missed).
+			WithField("failed", p.Failed).
+			WithField("complete", p.Complete).
+			Info("warming cache")
+	}
+	go func() {
+		defer close(mn.warmDone)
+		defer cancel()
+		if _, err := mn.Warm(ctx, opts); err != nil && !errors.Is(err, context.Canceled) {
+			logrus.WithError(err).WithField("cache", mn.name).Error("failed to warm cache")
+		}
+	}()
+}